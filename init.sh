@@ -1,19 +1,954 @@
 #!/bin/bash
 
+source "$(dirname "$0")/lib/common.sh"
+source "$(dirname "$0")/lib/batch.sh"
+source "$(dirname "$0")/lib/lock.sh"
+source "$(dirname "$0")/lib/report.sh"
+
 usage() {
-    echo "Usage: $0 --vm-name <vm-name> --namespace <namespace> --src-kubeconfig <file> --dst-kubeconfig <file> [--preserve-pod-ip] [--help]"
+    echo "Usage: $0 --vm-name <vm-name> --namespace <namespace> --src-kubeconfig <file> --dst-kubeconfig <file> [options]"
     echo
     echo "Options:"
-    echo "  --vm-name           Virtual machine name (required)"
+    echo "  --vm-name           Virtual machine name (required unless --all-vms)"
+    echo "  --vm-uid            Expected metadata.uid of the source VM (optional)"
+    echo "  --vm-file           VirtualMachine manifest to take --vm-name and --namespace from (optional)"
     echo "  --namespace         Namespace to work on (required)"
     echo "  --src-kubeconfig    Source kubeconfig file path (required)"
     echo "  --dst-kubeconfig    Destination kubeconfig file path (required)"
     echo "  --preserve-pod-ip   Preserve pod IP address during migration (optional)"
+    echo "  --only              Comma separated list of phases to run (optional)"
+    echo "  --skip              Comma separated list of phases to skip (optional)"
+    echo "  --cleanup-on-failure  Delete resources created by this run if a phase fails (optional)"
+    echo "  --no-cleanup-on-signal  Keep resources created by this run when it is interrupted (optional)"
+    echo "  --network-map       Map a source Multus network to a destination one, <src>=<dst> (optional, repeatable)"
+    echo "  --replicator-cpu    CPU request and limit of the replicator pods (optional)"
+    echo "  --replicator-memory Memory request and limit of the replicator pods (optional)"
+    echo "  --replicator-ttl    Seconds after which the replicator pods terminate on their own (optional)"
+    echo "  --replicator-termination-grace-period  Seconds the replicator pods get to stop when deleted (optional, default 30)"
+    echo "  --toleration        Toleration for the replicator and cronjob pods, key[=value][:effect] (optional, repeatable)"
+    echo "  --replicator-env    Environment variable for the replicators and the cronjob, NAME=value (optional, repeatable)"
+    echo "  --all-vms           Run for every VM in the source namespace (optional)"
+    echo "  --exclude-vm        VM to leave out of --all-vms (optional, repeatable)"
+    echo "  --vm-selector       Label selector restricting the VMs of --all-vms (optional)"
+    echo "  --max-retries-per-vm  Times a failed VM of --all-vms is retried (optional, default 0)"
+    echo "  --sync-script       Custom incremental sync script using \${NODE_PORT}, \${HOST_IP}, \${SYNC_TOOL} and \${DISK_IMAGE} (optional)"
+    echo "  --ssh-cipher        SSH cipher used by sshfs, one of: $SSH_CIPHERS (optional)"
+    echo "  --report-file       Write a JSON report of the run to this file (optional)"
+    echo "  --progress          Progress output, text or json (newline-delimited events on stdout, logs on stderr) (optional, default text)"
+    echo "  --allow-pvc-expansion  Expand the destination PVC if the source disk is larger (optional)"
+    echo "  --force             Stop a Running destination VM instead of refusing to continue (optional)"
+    echo "  --temp-dir          Directory for rendered manifests, SSH keys and the exported VM (optional, default \$TMPDIR or /tmp)"
+    echo "  --verbose-commands  Log every oc and virtctl command, with kubeconfig paths redacted (optional)"
+    echo "  --kube-extra-arg    Global flag added to every oc and virtctl command, e.g. --request-timeout=30s (optional, repeatable)"
+    echo "  --require-tls-verify  Fail instead of warning when a kubeconfig skips TLS verification (optional)"
+    echo "  --strip-annotations Comma separated VM annotations to remove before import (optional)"
+    echo "  --keep-annotations  Comma separated VM annotations to keep even if stripped by default (optional)"
+    echo "  --replicator-ready-cmd  Command that must succeed in a replicator pod after it is Ready, e.g. 'pgrep sshd' (optional)"
+    echo "  --replicator-capabilities  Comma separated capabilities to run the replicators unprivileged with, e.g. SYS_ADMIN (optional)"
+    echo "  --replicator-seccomp  Seccomp profile of the replicators: RuntimeDefault, Unconfined or Localhost/<profile> (optional)"
+    echo "  --replicator-pull-secret  Image pull secret for the source and destination replicator and cronjob pods (optional)"
+    echo "  --compress-transfer Compress the replication traffic between the replicators (optional)"
+    echo "  --copy-provider     Initial disk copy method, one of: $COPY_PROVIDERS (optional, default cp)"
+    echo "  --disk-image-name   File name of the disk image in the VM PVCs (optional, default disk.img)"
+    echo "  --mount-timeout     Seconds to wait for the sshfs and guestmount mounts to become usable (optional, default 30)"
+    echo "  --data-volume-size  Back the replicators' /data with an ephemeral PVC of this size (optional)"
+    echo "  --data-storage-class  Storage class of the --data-volume-size PVC (optional)"
+    echo "  --skip-persistent-state  Migrate VMs with persistent EFI/TPM state without that state (optional)"
+    echo "  --rotate-ssh-keys   Generate a new replication SSH key pair even if one exists (optional)"
+    echo "  --copy-instancetypes  Copy the instancetype and preference of the VM to the destination if missing (optional)"
+    echo "  --schedule-timezone Time zone of the cronjob schedule, e.g. Europe/Istanbul (optional)"
+    echo "  --sync-log-size     Keep the cronjob's sync logs on a PVC of this size, read them with logs.sh (optional)"
+    echo "  --proxy             HTTP(S) proxy URL for the sync tool in the cronjob (optional)"
+    echo "  --ca-bundle         PEM CA bundle trusted by the sync tool in the replicators and the cronjob (optional)"
+    echo "  --copy-referenced-resources  Copy Secrets, ConfigMaps and ServiceAccounts used by the VM to the destination (optional)"
+    echo "  --dst-vm-patch      YAML file merged into the destination VM before it is created (optional)"
+    echo "  --export-only       Write the rewritten destination VM to --output-dir instead of creating anything (optional)"
+    echo "  --output-dir        Directory for --export-only (optional)"
     echo "  --help              Display this help message and exit"
-    exit 1
+    echo
+    echo "Phases: $PHASES"
+    exit ${1:-$EXIT_USAGE}
+}
+
+# Rewrites the Multus networks of the exported VM according to --network-map
+# and verifies that every referenced NetworkAttachmentDefinition exists on the
+# destination cluster.
+map_networks() {
+    local vm_file=$1 nad_ns nad_name missing=()
+    for map in "${NETWORK_MAPS[@]}"; do
+        export NET_SRC=${map%%=*} NET_DST=${map#*=}
+        yq e -i '(.spec.template.spec.networks[] | select(.multus.networkName == strenv(NET_SRC)) | .multus.networkName) = strenv(NET_DST)' $vm_file
+    done
+    for net in `yq e '.spec.template.spec.networks[].multus.networkName | select(. != null)' $vm_file`; do
+        nad_ns=$NAMESPACE
+        nad_name=$net
+        if [[ $net == */* ]]; then
+            nad_ns=${net%%/*}
+            nad_name=${net#*/}
+        fi
+        if [[ -z $(oc get network-attachment-definitions $nad_name -n $nad_ns --kubeconfig $DST_KUBECONFIG --ignore-not-found -o name) ]]; then
+            missing+=("$net")
+        fi
+    done
+    if [[ ${#missing[@]} -gt 0 ]]; then
+        echo "Error: NetworkAttachmentDefinitions missing on the destination cluster: ${missing[*]}"
+        echo "Create them or use --network-map <src>=<dst>."
+        return 1
+    fi
+}
+
+# Converts a Kubernetes quantity such as 30Gi or 500M to bytes.
+quantity_to_bytes() {
+    awk -v n="${1%%[!0-9.]*}" -v u="${1##*[0-9.]}" 'BEGIN {
+        m["Ki"] = 2^10; m["Mi"] = 2^20; m["Gi"] = 2^30; m["Ti"] = 2^40; m["Pi"] = 2^50
+        m["k"] = 1e3; m["M"] = 1e6; m["G"] = 1e9; m["T"] = 1e12; m["P"] = 1e15; m[""] = 1
+        printf "%.0f\n", n * m[u]
+    }'
+}
+
+# Makes sure the destination PVC is at least as large as the source PVC,
+# expanding it when --allow-pvc-expansion is set and the storage class allows.
+check_pvc_size() {
+    local src_size dst_size storage_class
+    src_size=`oc get pvc $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.status.capacity.storage}'`
+    dst_size=`oc get pvc $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.spec.resources.requests.storage}'`
+    if [[ -z $src_size || -z $dst_size ]]; then
+        echo "Error: could not read the source or destination PVC size."
+        return 1
+    fi
+    if [[ `quantity_to_bytes $src_size` -le `quantity_to_bytes $dst_size` ]]; then
+        return 0
+    fi
+    if [[ $ALLOW_PVC_EXPANSION -ne 1 ]]; then
+        echo "Error: source disk ($src_size) is larger than the destination PVC ($dst_size). Use --allow-pvc-expansion to expand it."
+        return 1
+    fi
+    storage_class=`oc get pvc $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.spec.storageClassName}'`
+    if [[ $(oc get sc $storage_class --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.allowVolumeExpansion}') != "true" ]]; then
+        echo "Error: storage class $storage_class does not allow volume expansion."
+        return 1
+    fi
+    echo "Expanding destination PVC from $dst_size to $src_size"
+    oc patch pvc $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -p "{\"spec\":{\"resources\":{\"requests\":{\"storage\":\"$src_size\"}}}}"
+}
+
+# Removes server-managed and --strip-annotations annotations from the exported
+# VM, except those listed in --keep-annotations.
+filter_annotations() {
+    for annotation in $DEFAULT_STRIP_ANNOTATIONS ${STRIP_ANNOTATIONS//,/ }; do
+        if [[ ",$KEEP_ANNOTATIONS," == *",$annotation,"* ]]; then
+            continue
+        fi
+        export ANNOTATION=$annotation
+        yq e -i 'del(.metadata.annotations[strenv(ANNOTATION)])' $1
+    done
+}
+
+# Fails for VMs with persistent EFI or TPM state. KubeVirt keeps that state in
+# a separate backend-storage PVC which is not replicated, so without
+# --skip-persistent-state the destination VM would boot with fresh NVRAM.
+check_persistent_state() {
+    local efi tpm
+    efi=`yq e '.spec.template.spec.domain.firmware.bootloader.efi.persistent // false' $1`
+    tpm=`yq e '.spec.template.spec.domain.devices.tpm.persistent // false' $1`
+    if [[ $efi != "true" && $tpm != "true" ]]; then
+        return 0
+    fi
+    if [[ $SKIP_PERSISTENT_STATE -eq 1 ]]; then
+        echo "Warning: persistent EFI/TPM state of $VM_NAME is not replicated, the destination VM starts with fresh NVRAM."
+        return 0
+    fi
+    echo "Error: $VM_NAME uses persistent EFI/TPM state, which is stored outside the root disk and is not replicated."
+    echo "Use --skip-persistent-state to migrate it anyway; boot entries may need to be recreated on the destination."
+    return 1
+}
+
+# Prints "<kind> <name>" for every Secret, ConfigMap and ServiceAccount the
+# exported VM references through its volumes and access credentials.
+referenced_resources() {
+    yq e '
+        (.spec.template.spec.volumes[] | (.cloudInitNoCloud, .cloudInitConfigDrive) | (.secretRef.name, .networkDataSecretRef.name) | select(. != null) | "secret " + .),
+        (.spec.template.spec.volumes[].secret.secretName | select(. != null) | "secret " + .),
+        (.spec.template.spec.accessCredentials[] | (.sshPublicKey, .userPassword) | .source.secret.secretName | select(. != null) | "secret " + .),
+        (.spec.template.spec.volumes[].configMap.name | select(. != null) | "configmap " + .),
+        (.spec.template.spec.volumes[].serviceAccount.serviceAccountName | select(. != null) | "serviceaccount " + .)
+    ' $1 | sort -u
+}
+
+# Copies a namespaced resource from the source to the destination cluster,
+# without the server-managed metadata.
+copy_resource() {
+    oc get $1 $2 -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o yaml \
+        | yq e 'del(.metadata.uid, .metadata.resourceVersion, .metadata.creationTimestamp, .metadata.managedFields, .metadata.ownerReferences, .metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"]) | del(select(.kind == "ServiceAccount") | .secrets)' - \
+        | oc create -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f - || return 1
+    track_created $DST_KUBECONFIG $1 $2
+}
+
+# Makes sure the Secrets, ConfigMaps and ServiceAccounts referenced by the VM
+# exist on the destination cluster. Missing ones are copied from the source
+# with --copy-referenced-resources, otherwise they are only reported.
+copy_referenced_resources() {
+    local kind name
+    while read -r kind name; do
+        if [[ -z $kind || -n $(oc get $kind $name -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --ignore-not-found -o name) ]]; then
+            continue
+        fi
+        if [[ $COPY_REFERENCED_RESOURCES -ne 1 ]]; then
+            echo "Warning: $kind $name referenced by the VM does not exist on the destination cluster; use --copy-referenced-resources to copy it."
+            continue
+        fi
+        echo "Copying $kind $name to the destination cluster"
+        copy_resource $kind $name || return 1
+    done <<< "`referenced_resources $1`"
+}
+
+# Prints "<kind> <name>" for the instancetype and preference the exported VM
+# uses. A reference without a kind is to the cluster-wide kind.
+referenced_instancetypes() {
+    yq e '
+        (.spec.instancetype | select(. != null) | (.kind // "VirtualMachineClusterInstancetype") + " " + .name),
+        (.spec.preference | select(. != null) | (.kind // "VirtualMachineClusterPreference") + " " + .name)
+    ' $1
+}
+
+# Fails unless the instancetype and preference the VM uses exist on the
+# destination cluster. With --copy-instancetypes missing ones are copied from
+# the source instead.
+check_instancetypes() {
+    local kind name missing=()
+    while read -r kind name; do
+        if [[ -z $kind || -n $(oc get $kind $name -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --ignore-not-found -o name) ]]; then
+            continue
+        fi
+        if [[ $COPY_INSTANCETYPES -ne 1 ]]; then
+            missing+=("$kind/$name")
+            continue
+        fi
+        echo "Copying $kind $name to the destination cluster"
+        copy_resource $kind $name || return 1
+    done <<< "`referenced_instancetypes $1`"
+    if [[ ${#missing[@]} -gt 0 ]]; then
+        echo "Error: instancetypes/preferences missing on the destination cluster: ${missing[*]}"
+        echo "Create them or use --copy-instancetypes."
+        return 1
+    fi
+}
+
+# Records the source cluster, the VM's original creation time and the time of
+# the export in migrator.kloia.io/ annotations, for disaster-recovery audits.
+annotate_source() {
+    export SOURCE_CLUSTER=`oc whoami --show-server --kubeconfig $SRC_KUBECONFIG`
+    export MIGRATED_AT=`date -u +%Y-%m-%dT%H:%M:%SZ`
+    yq e -i '.metadata.annotations["migrator.kloia.io/source-cluster"] = strenv(SOURCE_CLUSTER) | .metadata.annotations["migrator.kloia.io/source-creation-timestamp"] = .metadata.creationTimestamp | .metadata.annotations["migrator.kloia.io/migrated-at"] = strenv(MIGRATED_AT)' $1
+}
+
+# Exports the source VM to a file and rewrites it for the destination cluster:
+# networks are mapped, source-specific annotations and instancetype revisions
+# removed, the source recorded in annotations, server-managed fields (status,
+# uid, resourceVersion, managedFields, owner references...) pruned,
+# --dst-vm-patch merged in and the VM is created stopped.
+export_vm() {
+    echo "Exporting VM from source cluster"
+    oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o yaml > $1 || return 1
+    if [[ $PRESERVE_POD_IP -eq 1 ]]; then
+        POD_IP=`oc get vmi $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.status.interfaces[0].ipAddress}'`"/23"
+        POD_MAC=`oc get vmi $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.status.interfaces[0].mac}'`
+        export ip_annotation="'{\"default\":{\"ip_address\":\"$POD_IP \",\"mac_address\":\"$POD_MAC\"}}'"
+        yq e -i '.spec.template.metadata.annotations["k8s.ovn.org/pod-networks"] = env(ip_annotation)' $1
+    fi
+    check_persistent_state $1 || return 1
+    map_networks $1 || return 1
+    yq e -i 'del(.metadata.annotations["migrator.kloia.io/lock"])' $1
+    yq e -i 'del(.spec.instancetype.revisionName, .spec.preference.revisionName)' $1
+    filter_annotations $1
+    annotate_source $1
+    yq e -i 'del(.status, .metadata.uid, .metadata.resourceVersion, .metadata.generation, .metadata.creationTimestamp, .metadata.managedFields, .metadata.ownerReferences)' $1
+    if [[ -n $DST_VM_PATCH ]]; then
+        yq ea -i 'select(fileIndex == 0) * select(fileIndex == 1)' $1 $DST_VM_PATCH || return 1
+    fi
+    yq e -i '.spec.running = false' $1
+}
+
+# Succeeds when none of the destination VM's DataVolumes is still being
+# imported or cloned into. A DataVolume waiting for its first consumer has
+# nothing to overwrite yet. A DataVolume from the VM's dataVolumeTemplates
+# that KubeVirt has not created yet counts as pending. Returns 2 if one of
+# them failed or cannot be read, or if a DataVolume the VM only references
+# does not exist, since waiting would not change that.
+datavolumes_settled() {
+    local templates dv found phase busy=()
+    templates=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.spec.dataVolumeTemplates[*].metadata.name}'` || return 2
+    for dv in `oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.spec.dataVolumeTemplates[*].metadata.name} {.spec.template.spec.volumes[*].dataVolume.name}' | tr ' ' '\n' | sort -u`; do
+        if ! found=(`oc get dv $dv -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --ignore-not-found -o=jsonpath='{.metadata.name} {.status.phase}'`); then
+            echo "Error: could not read DataVolume $dv on the destination cluster."
+            return 2
+        fi
+        if [[ ${#found[@]} -eq 0 && " $templates " == *" $dv "* ]]; then
+            busy+=("$dv(not created yet)")
+            continue
+        fi
+        if [[ ${#found[@]} -eq 0 ]]; then
+            echo "Error: DataVolume $dv used by the destination VM does not exist on the destination cluster."
+            return 2
+        fi
+        phase=${found[1]}
+        case $phase in
+            Succeeded|WaitForFirstConsumer|PendingPopulation)
+                ;;
+            Failed)
+                echo "Error: DataVolume $dv failed on the destination cluster."
+                return 2
+                ;;
+            *)
+                busy+=("$dv(${phase:-pending})")
+                ;;
+        esac
+    done
+    if [[ ${#busy[@]} -gt 0 ]]; then
+        echo "Waiting for destination DataVolumes: ${busy[*]}"
+        return 1
+    fi
+}
+
+# Waits until the destination DataVolumes are settled, so replication does
+# not write into a PVC that CDI is still populating.
+wait_for_datavolumes() {
+    wait_for 10 $DATAVOLUME_TIMEOUT datavolumes_settled
+    case $? in
+        0)
+            ;;
+        1)
+            echo "Error: destination DataVolumes still populating after ${DATAVOLUME_TIMEOUT}s."
+            return 1
+            ;;
+        *)
+            return 1
+            ;;
+    esac
+}
+
+# Creates the stopped destination VM from the source VM definition, or stops
+# the destination VM if it is already running.
+phase_dest_vm() {
+    echo "Checking source VM status"
+    src_vm_state=`vm_status $SRC_KUBECONFIG`
+    if [[ -n $src_vm_state ]]; then echo $src_vm_state; else echo "No Running VM" ; fi
+
+    echo "Checking destination VM status"
+    dst_vm_state=`vm_status $DST_KUBECONFIG`
+    if [[ -n $dst_vm_state ]]; then echo $dst_vm_state; else echo "No Running VM"; fi
+
+    if [[ $dst_vm_state != "Stopped" ]]; then
+        vm_exists $DST_KUBECONFIG
+        dst_vm_exists=$?
+        if [[ $dst_vm_exists -eq 2 ]]; then
+            echo "Error: could not check whether the destination VM exists."
+            return 1
+        fi
+        if [[ $dst_vm_exists -eq 1 ]]; then
+            export_vm $WORK_DIR/$VM_NAME-vm.yaml || return 1
+            copy_referenced_resources $WORK_DIR/$VM_NAME-vm.yaml || return 1
+            check_instancetypes $WORK_DIR/$VM_NAME-vm.yaml || return 1
+            oc apply --wait -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f $WORK_DIR/$VM_NAME-vm.yaml || return 1
+            track_created $DST_KUBECONFIG vm $VM_NAME
+        fi
+        vmi_absent $DST_KUBECONFIG
+        case $? in
+            1)
+                if [[ $FORCE -ne 1 ]]; then
+                    echo "Error: destination VM $VM_NAME is $dst_vm_state and has a running instance; replicating onto its disk would corrupt it. Use --force to stop it and continue."
+                    return 1
+                fi
+                echo "Stopping destination VM (--force)"
+                virtctl stop $VM_NAME --kubeconfig $DST_KUBECONFIG || return 1
+                wait_for 5 0 vmi_absent $DST_KUBECONFIG || return 1
+                ;;
+            2)
+                echo "Error: could not check whether the destination VM is running."
+                return 1
+                ;;
+        esac
+    fi
+    # A new VM reports Provisioning, or DataVolumeError, rather than Stopped
+    # while CDI populates its disks, so the DataVolumes are waited for
+    # directly, with a timeout and failing on an error.
+    wait_for_datavolumes || return 1
+    check_pvc_size
+}
+
+# Waits for a replicator pod to become Ready and, with --replicator-ready-cmd,
+# for that command to succeed in it.
+wait_for_replicator() {
+    wait_for_pod $1 $2 || return 1
+    if [[ -n $REPLICATOR_READY_CMD ]] && ! wait_for 5 $READY_CMD_TIMEOUT replicator_ready $1 $2; then
+        echo "Error: --replicator-ready-cmd did not succeed in pod $1 within ${READY_CMD_TIMEOUT}s"
+        return 1
+    fi
+}
+
+# Succeeds when --replicator-ready-cmd exits 0 in the pod, e.g. once sshd is
+# up in an image that starts it after the pod turns Ready.
+replicator_ready() {
+    oc exec $1 -n $NAMESPACE --kubeconfig $2 -- /bin/sh -c "$REPLICATOR_READY_CMD" > /dev/null 2>&1 || return 1
+}
+
+# Applies --replicator-cpu and --replicator-memory to a replicator manifest.
+set_replicator_resources() {
+    if [[ -n $REPLICATOR_CPU ]]; then
+        yq e -i '.spec.containers[0].resources.requests.cpu = strenv(REPLICATOR_CPU) | .spec.containers[0].resources.limits.cpu = strenv(REPLICATOR_CPU)' $1
+    fi
+    if [[ -n $REPLICATOR_MEMORY ]]; then
+        yq e -i '.spec.containers[0].resources.requests.memory = strenv(REPLICATOR_MEMORY) | .spec.containers[0].resources.limits.memory = strenv(REPLICATOR_MEMORY)' $1
+    fi
+}
+
+# Sets activeDeadlineSeconds on a replicator manifest from --replicator-ttl,
+# so replicators left behind by an abandoned migration terminate on their own.
+set_replicator_ttl() {
+    if [[ -n $REPLICATOR_TTL ]]; then
+        yq e -i '.spec.activeDeadlineSeconds = env(REPLICATOR_TTL)' $1
+    fi
+}
+
+# Sets terminationGracePeriodSeconds on a replicator manifest from
+# --replicator-termination-grace-period, giving an in-flight copy or sshfs
+# session more time to stop before the pod is killed on deletion.
+set_replicator_grace_period() {
+    if [[ -n $REPLICATOR_GRACE_PERIOD ]]; then
+        yq e -i '.spec.terminationGracePeriodSeconds = env(REPLICATOR_GRACE_PERIOD)' $1
+    fi
+}
+
+# Renders the --toleration flags into the pod spec at the given yq path,
+# replacing any tolerations left from a previous run.
+set_replicator_tolerations() {
+    local tol
+    yq e -i "del($2.tolerations)" $1
+    for tol in "${TOLERATIONS[@]}"; do
+        export TOL_KEY TOL_VALUE="" TOL_OPERATOR="Exists" TOL_EFFECT=""
+        if [[ $tol == *:* ]]; then
+            TOL_EFFECT=${tol##*:}
+            tol=${tol%:*}
+        fi
+        TOL_KEY=${tol%%=*}
+        if [[ $tol == *=* ]]; then
+            TOL_VALUE=${tol#*=}
+            TOL_OPERATOR="Equal"
+        fi
+        yq e -i "$2.tolerations += [{\"key\": strenv(TOL_KEY), \"operator\": strenv(TOL_OPERATOR)}]" $1
+        if [[ -n $TOL_VALUE ]]; then
+            yq e -i "$2.tolerations[-1].value = strenv(TOL_VALUE)" $1
+        fi
+        if [[ -n $TOL_EFFECT ]]; then
+            yq e -i "$2.tolerations[-1].effect = strenv(TOL_EFFECT)" $1
+        fi
+    done
+}
+
+# Renders --replicator-pull-secret into the pod spec at the given yq path, or
+# removes imagePullSecrets when it is not set. It is used for both replicator
+# images: the migrator image of the source replicator and the cronjob, and
+# the ssh-server image of the destination replicator.
+set_pull_secret() {
+    if [[ -n $REPLICATOR_PULL_SECRET ]]; then
+        yq e -i "$2.imagePullSecrets = [{\"name\": strenv(REPLICATOR_PULL_SECRET)}]" $1
+    else
+        yq e -i "del($2.imagePullSecrets)" $1
+    fi
+}
+
+# Sets HTTP_PROXY and HTTPS_PROXY on the cronjob container from --proxy, so a
+# sync tool reaching a remote backend goes through it, or removes the
+# variables when --proxy is not set.
+set_proxy_env() {
+    local env=.spec.jobTemplate.spec.template.spec.containers[0].env
+    yq e -i "del($env[] | select(.name == \"HTTP_PROXY\" or .name == \"HTTPS_PROXY\"))" $1
+    if [[ -n $PROXY ]]; then
+        yq e -i "$env += [{\"name\": \"HTTP_PROXY\", \"value\": strenv(PROXY)}, {\"name\": \"HTTPS_PROXY\", \"value\": strenv(PROXY)}]" $1
+    fi
+}
+
+# Adds the --replicator-env variables to the env of the container at the
+# given yq path.
+set_replicator_env() {
+    local var
+    for var in "${REPLICATOR_ENVS[@]}"; do
+        export ENV_NAME=${var%%=*} ENV_VALUE=${var#*=}
+        yq e -i "$2.env += [{\"name\": strenv(ENV_NAME), \"value\": strenv(ENV_VALUE)}]" $1
+    done
+}
+
+# Creates or updates the <vm-name>-repl-ca ConfigMap holding the --ca-bundle
+# file on the cluster of the given kubeconfig. Does nothing without
+# --ca-bundle.
+apply_ca_bundle() {
+    local exists
+    if [[ -z $CA_BUNDLE ]]; then
+        return 0
+    fi
+    exists=`oc get configmap $VM_NAME-repl-ca -n $NAMESPACE --kubeconfig $1 --ignore-not-found -o name`
+    oc create configmap $VM_NAME-repl-ca --from-file=ca.crt=$CA_BUNDLE -n $NAMESPACE --dry-run=client -o yaml | oc label --local -f - $MANAGED_BY_LABEL -o yaml | oc apply -n $NAMESPACE --kubeconfig $1 -f - > /dev/null || return 1
+    if [[ -z $exists ]]; then
+        track_created $1 configmap $VM_NAME-repl-ca
+    fi
+}
+
+# Mounts the --ca-bundle ConfigMap into the first container of the pod spec at
+# the given yq path and points SSL_CERT_FILE at it, which the sync tool and
+# other TLS clients in the image use instead of the system CA store.
+set_ca_bundle() {
+    local pod=$2
+    if [[ -z $CA_BUNDLE ]]; then
+        return 0
+    fi
+    yq e -i "$pod.volumes += [{\"name\": \"ca\", \"configMap\": {\"name\": strenv(VM_NAME) + \"-repl-ca\"}}] | $pod.containers[0].volumeMounts += [{\"name\": \"ca\", \"mountPath\": \"/etc/kubevirt-migrator/ca\", \"readOnly\": true}] | $pod.containers[0].env += [{\"name\": \"SSL_CERT_FILE\", \"value\": \"/etc/kubevirt-migrator/ca/ca.crt\"}]" $1
+}
+
+# Renders the security context of the container at the given yq path: the
+# default privileged: true, or with --replicator-capabilities an unprivileged
+# one adding those capabilities, plus the --replicator-seccomp profile.
+set_security_context() {
+    local sc=$2.securityContext
+    if [[ -z $REPLICATOR_CAPABILITIES ]]; then
+        yq e -i "$sc = {\"privileged\": true}" $1
+    else
+        yq e -i "$sc = {\"privileged\": false, \"capabilities\": {\"add\": (strenv(REPLICATOR_CAPABILITIES) | split(\",\"))}}" $1
+    fi
+    case $REPLICATOR_SECCOMP in
+        "")
+            ;;
+        Localhost/*)
+            export SECCOMP_PROFILE=${REPLICATOR_SECCOMP#Localhost/}
+            yq e -i "$sc.seccompProfile = {\"type\": \"Localhost\", \"localhostProfile\": strenv(SECCOMP_PROFILE)}" $1
+            ;;
+        *)
+            yq e -i "$sc.seccompProfile = {\"type\": strenv(REPLICATOR_SECCOMP)}" $1
+            ;;
+    esac
+}
+
+# Backs the replicator's /data scratch directory with an ephemeral PVC when
+# --data-volume-size is set, or with an emptyDir otherwise.
+set_data_volume() {
+    if [[ -z $DATA_VOLUME_SIZE ]]; then
+        yq e -i '(.spec.volumes[] | select(.name == "data")) = {"name": "data", "emptyDir": {}}' $1
+        return
+    fi
+    yq e -i '(.spec.volumes[] | select(.name == "data")) = {"name": "data", "ephemeral": {"volumeClaimTemplate": {"spec": {"accessModes": ["ReadWriteOnce"], "resources": {"requests": {"storage": strenv(DATA_VOLUME_SIZE)}}}}}}' $1
+    if [[ -n $DATA_STORAGE_CLASS ]]; then
+        yq e -i '(.spec.volumes[] | select(.name == "data")).ephemeral.volumeClaimTemplate.spec.storageClassName = strenv(DATA_STORAGE_CLASS)' $1
+    fi
+}
+
+check_replicators() {
+    echo "Checking source Replicator"
+    src_repl_state=`pod_status $VM_NAME-src-replicator $SRC_KUBECONFIG`
+    if [[ -n $src_repl_state ]]; then echo $src_repl_state; else echo "No Running Replicator" ; fi
+
+    echo "Checking destination Replicator"
+    dst_repl_state=`pod_status $VM_NAME-dst-replicator $DST_KUBECONFIG`
+    if [[ -n $dst_repl_state ]]; then echo $dst_repl_state; else echo "No Running Replicator" ; fi
+}
+
+# Fails unless the VM on the cluster of the given kubeconfig uses the PVC the
+# replicators mount as its disk, which is the one named after the VM. A
+# DataVolume volume counts, since CDI names its PVC after the DataVolume. The
+# second argument names the cluster in the message.
+check_vm_claim() {
+    local claims
+    claims=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $1 -o=jsonpath='{.spec.template.spec.volumes[*].persistentVolumeClaim.claimName} {.spec.template.spec.volumes[*].dataVolume.name}'` || return 1
+    if [[ " $claims " != *" $VM_NAME "* ]]; then
+        echo "Error: the $2 VM does not use a PVC or DataVolume named $VM_NAME, which the replicators mount as its disk (found: `echo $claims`)."
+        return 1
+    fi
+}
+
+# Fails if the VM's PVC on the cluster of the given kubeconfig is a raw block
+# device. The replicators mount the PVC as a filesystem and copy its disk image
+# file, and a block device can neither be mounted that way nor be written
+# through sshfs. The second argument names the cluster in the message.
+check_volume_mode() {
+    local mode
+    mode=`oc get pvc $VM_NAME -n $NAMESPACE --kubeconfig $1 -o=jsonpath='{.spec.volumeMode}'` || return 1
+    if [[ $mode == "Block" ]]; then
+        echo "Error: PVC $VM_NAME on the $2 cluster has volumeMode Block; only Filesystem PVCs holding a disk image file are supported."
+        return 1
+    fi
+}
+
+# Fails unless the destination replicator can write to the destination disk
+# PVC, which the source replicator writes to over sshfs. A read-only or
+# root-squashed volume would otherwise only show up as a failed copy.
+check_dst_writable() {
+    local probe=/data/simg/.kubevirt-migrator-probe
+    if ! oc exec $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -- /bin/sh -c "touch $probe && rm -f $probe" > /dev/null; then
+        echo "Error: the destination replicator cannot write to PVC $VM_NAME."
+        return 1
+    fi
+}
+
+# Creates the source and destination replicator pods and the destination
+# NodePort service, skipping replicators that are already running, then checks
+# the destination disk is writable.
+phase_replicators() {
+    check_vm_claim $SRC_KUBECONFIG source || return 1
+    check_vm_claim $DST_KUBECONFIG destination || return 1
+    check_volume_mode $SRC_KUBECONFIG source || return 1
+    check_volume_mode $DST_KUBECONFIG destination || return 1
+    check_replicators
+
+    if [[ $src_repl_state != "Running" ]]; then
+        if [[ $src_repl_state == "Failed" ]]; then
+            oc delete po $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --wait || return 1
+        fi
+        echo "Creating source Replicator"
+        yq -i '.metadata.name = strenv(VM_NAME)+"-src-replicator"' $WORK_DIR/manifests/src-repl.yaml
+        yq e -i '.metadata.labels.app = env(VM_NAME)+"-src-replicator"' $WORK_DIR/manifests/src-repl.yaml
+        yq e -i '.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' $WORK_DIR/manifests/src-repl.yaml
+        set_replicator_resources $WORK_DIR/manifests/src-repl.yaml
+        set_replicator_ttl $WORK_DIR/manifests/src-repl.yaml
+        set_replicator_grace_period $WORK_DIR/manifests/src-repl.yaml
+        set_replicator_tolerations $WORK_DIR/manifests/src-repl.yaml .spec
+        set_pull_secret $WORK_DIR/manifests/src-repl.yaml .spec
+        set_data_volume $WORK_DIR/manifests/src-repl.yaml
+        set_security_context $WORK_DIR/manifests/src-repl.yaml .spec.containers[0]
+        set_replicator_env $WORK_DIR/manifests/src-repl.yaml .spec.containers[0]
+        set_ca_bundle $WORK_DIR/manifests/src-repl.yaml .spec
+        apply_ca_bundle $SRC_KUBECONFIG || return 1
+        oc apply --wait -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -f $WORK_DIR/manifests/src-repl.yaml || return 1
+        track_created $SRC_KUBECONFIG pod $VM_NAME-src-replicator
+        wait_for_replicator $VM_NAME-src-replicator $SRC_KUBECONFIG || return 1
+    fi
+
+    if [[ $dst_repl_state != "Running" ]]; then
+        if [[ $dst_repl_state == "Failed" ]]; then
+            oc delete po $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --wait || return 1
+        fi
+        echo "Creating destination Replicator"
+        yq e -i '.metadata.name = env(VM_NAME)+"-dst-replicator"' $WORK_DIR/manifests/dst-repl.yaml
+        yq e -i '.metadata.labels.app = env(VM_NAME)+"-dst-replicator"' $WORK_DIR/manifests/dst-repl.yaml
+        yq e -i '.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' $WORK_DIR/manifests/dst-repl.yaml
+        set_replicator_resources $WORK_DIR/manifests/dst-repl.yaml
+        set_replicator_ttl $WORK_DIR/manifests/dst-repl.yaml
+        set_replicator_grace_period $WORK_DIR/manifests/dst-repl.yaml
+        set_replicator_tolerations $WORK_DIR/manifests/dst-repl.yaml .spec
+        set_pull_secret $WORK_DIR/manifests/dst-repl.yaml .spec
+        set_data_volume $WORK_DIR/manifests/dst-repl.yaml
+        set_security_context $WORK_DIR/manifests/dst-repl.yaml .spec.containers[0]
+        set_replicator_env $WORK_DIR/manifests/dst-repl.yaml .spec.containers[0]
+        set_ca_bundle $WORK_DIR/manifests/dst-repl.yaml .spec
+        apply_ca_bundle $DST_KUBECONFIG || return 1
+        oc apply --wait -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f $WORK_DIR/manifests/dst-repl.yaml || return 1
+        track_created $DST_KUBECONFIG pod $VM_NAME-dst-replicator
+        yq e -i '.metadata.name = env(VM_NAME)+"-dst-svc"' $WORK_DIR/manifests/dst-repl-svc.yaml
+        yq e -i '.metadata.labels.app = env(VM_NAME)+"-dst-replicator"' $WORK_DIR/manifests/dst-repl-svc.yaml
+        yq e -i '.spec.selector.app = env(VM_NAME)+"-dst-replicator"' $WORK_DIR/manifests/dst-repl-svc.yaml
+        wait_for_replicator $VM_NAME-dst-replicator $DST_KUBECONFIG || return 1
+        oc apply -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f $WORK_DIR/manifests/dst-repl-svc.yaml || return 1
+        track_created $DST_KUBECONFIG svc $VM_NAME-dst-svc
+    fi
+    check_dst_writable
+}
+
+# Prints the in-pod command creating the source replicator's key pair unless
+# it already exists. With --rotate-ssh-keys an existing pair is replaced.
+keygen_command() {
+    if [[ $ROTATE_SSH_KEYS -eq 1 ]]; then
+        echo "rm -f ~/.ssh/id_rsa ~/.ssh/id_rsa.pub; ssh-keygen -t rsa -b 4096 -N '' -f ~/.ssh/id_rsa"
+        return
+    fi
+    echo "[ -f ~/.ssh/id_rsa ] || ssh-keygen -t rsa -b 4096 -N '' -f ~/.ssh/id_rsa"
+}
+
+# Prints the in-pod command authorizing the given public key on the
+# destination replicator.
+authorize_key_command() {
+    echo "mkdir ~/.ssh; echo '$1' > ~/.ssh/authorized_keys; chmod 600 ~/.ssh/authorized_keys"
+}
+
+# Prints a key file stored in the SSH secret, e.g. id_rsa.pub, decoded.
+secret_key() {
+    oc get secret $VM_NAME-repl-ssh-keys -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath="{.data.${1//./\\.}}" | base64 -d
+}
+
+# Installs the keys of the SSH secret in the source replicator, so a recreated
+# pod keeps the key the cronjob uses and the destination replicator trusts.
+install_secret_keys() {
+    secret_key id_rsa | oc exec $VM_NAME-src-replicator -i -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- bash -c "mkdir -p ~/.ssh && cat > ~/.ssh/id_rsa && chmod 600 ~/.ssh/id_rsa" || return 1
+    secret_key id_rsa.pub | oc exec $VM_NAME-src-replicator -i -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- bash -c "cat > ~/.ssh/id_rsa.pub" || return 1
+}
+
+# Sets up the source replicator SSH key and authorizes it on the destination
+# replicator, replacing any previously authorized key. An existing SSH secret
+# is reused as is unless --rotate-ssh-keys is set: its keys are installed in
+# the source replicator, so a recreated pod keeps the key the cronjob uses.
+# Otherwise the key is generated in the source replicator (unless it already
+# has one and --rotate-ssh-keys is not set) and stored in the secret.
+phase_ssh() {
+    secret_exists=`oc get secret $VM_NAME-repl-ssh-keys -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --ignore-not-found -o name`
+    if [[ -n $secret_exists && $ROTATE_SSH_KEYS -ne 1 ]]; then
+        echo "Reusing source SSH secret"
+        install_secret_keys || return 1
+        src_ssh_key=`secret_key id_rsa.pub`
+    else
+        echo "Generating source replicator SSH key"
+        oc exec $VM_NAME-src-replicator -ti -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- bash -c "`keygen_command`"
+        echo "Generating source SSH secret"
+        oc cp $VM_NAME-src-replicator:/root/.ssh/id_rsa $WORK_DIR/id_rsa -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
+        oc cp $VM_NAME-src-replicator:/root/.ssh/id_rsa.pub $WORK_DIR/id_rsa.pub -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
+        oc create secret generic $VM_NAME-repl-ssh-keys --from-file=$WORK_DIR/id_rsa --from-file=$WORK_DIR/id_rsa.pub -n $NAMESPACE --dry-run=client -o yaml | oc label --local -f - $MANAGED_BY_LABEL -o yaml | oc apply -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -f - || return 1
+        if [[ -z $secret_exists ]]; then
+            track_created $SRC_KUBECONFIG secret $VM_NAME-repl-ssh-keys
+        fi
+        src_ssh_key=`oc exec $VM_NAME-src-replicator -ti -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- bash -c "cat ~/.ssh/id_rsa.pub"`
+    fi
+    echo "Authorizing source SSH key on destination Replicator"
+    oc exec $VM_NAME-dst-replicator -ti -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -- bash -c "`authorize_key_command "$src_ssh_key"`"
+}
+
+# Resolves the NodePort and host IP the source replicator uses to reach the
+# destination replicator. Returns non-zero if either replicator is not running.
+get_destination_info() {
+    check_replicators
+    if [[ $src_repl_state != "Running" || $dst_repl_state != "Running" ]]; then
+        echo "Error: source and destination Replicators must be Running."
+        return 1
+    fi
+    echo "Getting destination NodePort"
+    dst_node_port=`oc get svc $VM_NAME-dst-svc -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.spec.ports[0].nodePort}'`
+    export DST_NODE_PORT=$dst_node_port
+    echo "Getting destination Host IP"
+    dst_host_ip=`oc get po $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.status.hostIP}'`
+    export DST_HOST_IP=$dst_host_ip
+}
+
+# Prints the sshfs options used to mount the destination replicator's disk.
+sshfs_options() {
+    echo -n "-o StrictHostKeyChecking=no -o port=$DST_NODE_PORT"
+    if [[ -n $SSH_CIPHER ]]; then
+        echo -n " -o Ciphers=$SSH_CIPHER"
+    fi
+    if [[ $COMPRESS_TRANSFER -eq 1 ]]; then
+        echo -n " -o compression=yes"
+    fi
+}
+
+# Prints the in-pod command mounting the destination replicator's /data/simg
+# on /data/dimg over sshfs.
+sshfs_mount_command() {
+    echo "sshfs `sshfs_options` $DST_HOST_IP:/data/simg /data/dimg"
+}
+
+# Prints the in-pod command waiting up to --mount-timeout seconds for the given
+# directory to become a listable mount point. FUSE mounts are not always
+# usable the moment sshfs or guestmount returns. It runs in a subshell that
+# fails when the timeout expires, so callers chain the next step with &&.
+wait_mounted_command() {
+    echo "(i=0; until mountpoint -q $1 && ls $1 > /dev/null; do [ \$i -ge $MOUNT_TIMEOUT ] && { echo '$1 is not mounted'; exit 1; }; i=\$((i + 1)); sleep 1; done)"
+}
+
+# Prints the in-pod commands mounting the root filesystem of the source disk
+# read-only on /data/sfs and of the destination disk read-write on /data/dfs.
+guestmount_commands() {
+    echo "guestmount -a /data/simg/$DISK_IMAGE -m /dev/sda4 --ro /data/sfs && guestmount -a /data/dimg/$DISK_IMAGE -m /dev/sda4 --rw /data/dfs"
+}
+
+# Prints the in-pod command syncing the mounted source filesystem to the
+# destination one.
+sync_tool_command() {
+    echo "$SYNC_TOOL sync --progress /data/sfs/ /data/dfs/ --skip-links --checkers 8 --contimeout 100s --timeout 300s --retries 3 --low-level-retries 10 --drive-acknowledge-abuse --stats 1s --cutoff-mode=soft"
+}
+
+# Prints the command copying the source disk image onto the mounted
+# destination disk for the selected --copy-provider. rsync-block only rewrites
+# the blocks that differ, so a re-run after a failed copy resumes instead of
+# starting over.
+initial_copy_command() {
+    case $COPY_PROVIDER in
+        rsync-block)
+            echo "rsync --inplace --sparse --no-whole-file --progress /data/simg/$DISK_IMAGE /data/dimg/"
+            ;;
+        *)
+            echo "cp -p --sparse=always /data/simg/$DISK_IMAGE /data/dimg/ & progress -m; wait \$!"
+            ;;
+    esac
+}
+
+phase_initial_sync() {
+    get_destination_info || return 1
+    verify_replicator_tools || return 1
+    echo "Starting initial volume replication"
+    oc exec $VM_NAME-src-replicator -ti -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- /bin/bash -c "mkdir /data/dimg; `sshfs_mount_command` && `wait_mounted_command /data/dimg` && { `initial_copy_command`; }"
+}
+
+# Verifies that the tools used by the initial copy and the cronjob exist in
+# the replicator image, which the cronjob shares with the source replicator:
+# the sync tool, the --copy-provider tools and the mount tools. All of them
+# are probed in a single exec and reported together.
+verify_replicator_tools() {
+    local tools="$SYNC_TOOL $REPLICATOR_TOOLS" missing
+    case $COPY_PROVIDER in
+        rsync-block)
+            tools="$tools rsync"
+            ;;
+        *)
+            tools="$tools progress"
+            ;;
+    esac
+    echo "Checking the source Replicator has: $tools"
+    missing=`oc exec $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- /bin/sh -c "for t in $tools; do command -v \$t > /dev/null || echo \$t; done"` || return 1
+    if [[ -n $missing ]]; then
+        echo "Error: missing from the source replicator image: `echo $missing`"
+        return 1
+    fi
+}
+
+# Prints the built-in incremental sync script run by the cronjob. Each step
+# only runs if the previous one succeeded, and the script fails with it. The
+# guest filesystems are unmounted at the end either way, so the destination
+# writes are flushed before the job's pod exits.
+default_sync_script() {
+    echo "mkdir /data/dimg /data/dfs /data/sfs/; `sshfs_mount_command` && `wait_mounted_command /data/dimg` && `guestmount_commands` && `wait_mounted_command /data/sfs` && `wait_mounted_command /data/dfs` && `sync_tool_command`; rc=\$?; guestunmount /data/dfs; guestunmount /data/sfs; [ \$rc -eq 0 ]"
+}
+
+# Prints the command run by the cronjob: the built-in sync script, or the
+# --sync-script template with its placeholders substituted, base64 encoded
+# so it survives the YAML and /bin/sh -c quoting.
+sync_command() {
+    if [[ -z $SYNC_SCRIPT ]]; then
+        default_sync_script
+        return
+    fi
+    local script=`cat $SYNC_SCRIPT`
+    script=${script//'${NODE_PORT}'/$DST_NODE_PORT}
+    script=${script//'${HOST_IP}'/$DST_HOST_IP}
+    script=${script//'${SYNC_TOOL}'/$SYNC_TOOL}
+    script=${script//'${DISK_IMAGE}'/$DISK_IMAGE}
+    echo "echo `echo "$script" | base64 -w0` | base64 -d | /bin/bash"
+}
+
+# Wraps the cronjob command so its output is also written to a timestamped
+# file on the sync log PVC. Only the newest SYNC_LOG_KEEP files are kept.
+logged_command() {
+    echo "log=/var/log/repl/sync-\$(date +%Y%m%d-%H%M%S).log; { $1; } > \$log 2>&1; rc=\$?; cat \$log; ls -t /var/log/repl/sync-*.log | tail -n +$((SYNC_LOG_KEEP + 1)) | xargs -r rm -f; exit \$rc"
+}
+
+# Creates the PVC keeping the cronjob's sync logs when --sync-log-size is set,
+# and mounts it into the cronjob, or removes the mount otherwise.
+set_sync_log_volume() {
+    local pod=.spec.jobTemplate.spec.template.spec
+    yq e -i "del($pod.volumes[] | select(.name == \"logs\")) | del($pod.containers[0].volumeMounts[] | select(.name == \"logs\"))" $WORK_DIR/manifests/src-cronjob.yaml
+    if [[ -z $SYNC_LOG_SIZE ]]; then
+        return 0
+    fi
+    if [[ -z $(oc get pvc $VM_NAME-repl-logs -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --ignore-not-found -o name) ]]; then
+        echo "Creating sync log PVC"
+        yq e -i '.metadata.name = env(VM_NAME)+"-repl-logs"' $WORK_DIR/manifests/src-sync-logs-pvc.yaml
+        yq e -i '.spec.resources.requests.storage = strenv(SYNC_LOG_SIZE)' $WORK_DIR/manifests/src-sync-logs-pvc.yaml
+        oc apply -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -f $WORK_DIR/manifests/src-sync-logs-pvc.yaml || return 1
+        track_created $SRC_KUBECONFIG pvc $VM_NAME-repl-logs
+    fi
+    yq e -i "$pod.volumes += [{\"name\": \"logs\", \"persistentVolumeClaim\": {\"claimName\": strenv(VM_NAME) + \"-repl-logs\"}}] | $pod.containers[0].volumeMounts += [{\"name\": \"logs\", \"mountPath\": \"/var/log/repl\"}]" $WORK_DIR/manifests/src-cronjob.yaml
+}
+
+phase_cronjob() {
+    get_destination_info || return 1
+    verify_replicator_tools || return 1
+    echo "Creating CronJob for async replication"
+    export SYNC_COMMAND=`sync_command`
+    if [[ -n $SYNC_LOG_SIZE ]]; then
+        SYNC_COMMAND=`logged_command "$SYNC_COMMAND"`
+    fi
+    yq e -i '.metadata.name = env(VM_NAME)+"-repl-cronjob"' $WORK_DIR/manifests/src-cronjob.yaml
+    yq e -i '.spec.jobTemplate.spec.template.spec.containers[0].command[2] = strenv(SYNC_COMMAND)' $WORK_DIR/manifests/src-cronjob.yaml
+    yq e -i '.spec.jobTemplate.spec.template.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' $WORK_DIR/manifests/src-cronjob.yaml
+    yq e -i '.spec.jobTemplate.spec.template.spec.volumes[1].secret.secretName = env(VM_NAME)+"-repl-ssh-keys"' $WORK_DIR/manifests/src-cronjob.yaml
+    set_pull_secret $WORK_DIR/manifests/src-cronjob.yaml .spec.jobTemplate.spec.template.spec
+    set_replicator_tolerations $WORK_DIR/manifests/src-cronjob.yaml .spec.jobTemplate.spec.template.spec
+    set_security_context $WORK_DIR/manifests/src-cronjob.yaml .spec.jobTemplate.spec.template.spec.containers[0]
+    set_proxy_env $WORK_DIR/manifests/src-cronjob.yaml
+    set_replicator_env $WORK_DIR/manifests/src-cronjob.yaml .spec.jobTemplate.spec.template.spec.containers[0]
+    set_ca_bundle $WORK_DIR/manifests/src-cronjob.yaml .spec.jobTemplate.spec.template.spec
+    apply_ca_bundle $SRC_KUBECONFIG || return 1
+    set_sync_log_volume || return 1
+    if [[ -n $SCHEDULE_TIMEZONE ]]; then
+        yq e -i '.spec.timeZone = strenv(SCHEDULE_TIMEZONE)' $WORK_DIR/manifests/src-cronjob.yaml
+    else
+        yq e -i 'del(.spec.timeZone)' $WORK_DIR/manifests/src-cronjob.yaml
+    fi
+    oc apply -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -f $WORK_DIR/manifests/src-cronjob.yaml
+}
+
+# Records a resource created by this run. Resources that already existed are
+# never recorded, so cleanup cannot delete a user's VM.
+track_created() {
+    CREATED_RESOURCES+=("$1 $2 $3")
+}
+
+# Deletes the resources recorded by track_created, newest first.
+cleanup_created_resources() {
+    local kubeconfig kind name
+    for ((i=${#CREATED_RESOURCES[@]}-1; i>=0; i--)); do
+        read -r kubeconfig kind name <<< "${CREATED_RESOURCES[$i]}"
+        echo "Deleting $kind $name"
+        oc delete $kind $name -n $NAMESPACE --kubeconfig $kubeconfig --wait --ignore-not-found
+    done
+}
+
+# SIGINT and SIGTERM handler: deletes the resources this run created, unless
+# --no-cleanup-on-signal is set, and exits so the exit hooks (lock release,
+# report) still run. Further signals are ignored while it cleans up.
+on_signal() {
+    trap '' INT TERM
+    LAST_ERROR="interrupted"
+    echo
+    echo "Error: $LAST_ERROR."
+    if [[ $CLEANUP_ON_SIGNAL -eq 1 && ${#CREATED_RESOURCES[@]} -gt 0 ]]; then
+        echo "Cleaning up resources created by this run"
+        cleanup_created_resources
+    fi
+    exit 130
+}
+
+# Reports whether a phase should run given the --only and --skip lists.
+phase_enabled() {
+    if [[ -n "$ONLY_PHASES" && ",$ONLY_PHASES," != *",$1,"* ]]; then
+        return 1
+    fi
+    [[ ",$SKIP_PHASES," != *",$1,"* ]]
+}
+
+# With --progress json, writes an event as one line of JSON to the original
+# stdout, which the main flow keeps on fd 3 while the logs go to stderr. The
+# first argument is the event type, the second the phase if any. The percent
+# is the share of phases completed or skipped so far.
+progress_event() {
+    if [[ $PROGRESS != "json" ]]; then
+        return
+    fi
+    export EVENT_TYPE=$1 EVENT_PHASE=${2:-} EVENT_ERROR=${LAST_ERROR:-}
+    export EVENT_PERCENT=$((PHASES_DONE * 100 / `echo $PHASES | wc -w`))
+    yq -n -o json -I 0 '.event = strenv(EVENT_TYPE) |
+        .vm = strenv(VM_NAME) |
+        .phase = strenv(EVENT_PHASE) |
+        .percent = env(EVENT_PERCENT) |
+        .error = strenv(EVENT_ERROR)' >&3
+}
+
+# Exit hook writing the final completed or failed --progress json event.
+progress_finished() {
+    if [[ $EXIT_STATUS -eq 0 ]]; then
+        PHASES_DONE=`echo $PHASES | wc -w`
+        progress_event completed
+    else
+        LAST_ERROR=${LAST_ERROR:-exited with status $EXIT_STATUS}
+        progress_event failed
+    fi
 }
 
 VM_NAME=""
+VM_UID=""
+VM_FILE=""
 NAMESPACE=""
 SRC_KUBECONFIG=""
 DST_KUBECONFIG=""
@@ -22,7 +957,69 @@ PVC_NAME=""
 DST_HOST_IP=""
 DST_NODE_PORT=""
 PRESERVE_POD_IP=0
+DATAVOLUME_TIMEOUT=3600
+SYNC_TOOL="rclone"
+SYNC_SCRIPT=""
+EXPORT_ONLY=0
+DST_VM_PATCH=""
+OUTPUT_DIR=""
+ALLOW_PVC_EXPANSION=0
+SKIP_PERSISTENT_STATE=0
+COPY_REFERENCED_RESOURCES=0
+PROXY=""
+CA_BUNDLE=""
+SYNC_LOG_SIZE=""
+SYNC_LOG_KEEP=20
+SCHEDULE_TIMEZONE=""
+ROTATE_SSH_KEYS=0
+COPY_INSTANCETYPES=0
+DEFAULT_STRIP_ANNOTATIONS="kubevirt.io/latest-observed-api-version kubevirt.io/storage-observed-api-version kubectl.kubernetes.io/last-applied-configuration"
+STRIP_ANNOTATIONS=""
+KEEP_ANNOTATIONS=""
+COPY_PROVIDER="cp"
+DISK_IMAGE="disk.img"
+MOUNT_TIMEOUT=30
+COMPRESS_TRANSFER=0
+COPY_PROVIDERS="cp rsync-block"
+SSH_CIPHER=""
+SSH_CIPHERS="aes128-ctr aes192-ctr aes256-ctr aes128-gcm@openssh.com aes256-gcm@openssh.com chacha20-poly1305@openssh.com"
+REPLICATOR_TOOLS="sshfs guestmount guestunmount mountpoint virt-filesystems fdisk"
+PHASES="dest-vm replicators ssh initial-sync cronjob"
+ONLY_PHASES=""
+SKIP_PHASES=""
+CLEANUP_ON_FAILURE=0
+CLEANUP_ON_SIGNAL=1
+CREATED_RESOURCES=()
+NETWORK_MAPS=()
+REPLICATOR_CPU=""
+REPLICATOR_MEMORY=""
+REPLICATOR_TTL=""
+REPLICATOR_GRACE_PERIOD=""
+REPLICATOR_PULL_SECRET=""
+REPLICATOR_READY_CMD=""
+REPLICATOR_CAPABILITIES=""
+REPLICATOR_SECCOMP=""
+READY_CMD_TIMEOUT=300
+DATA_VOLUME_SIZE=""
+DATA_STORAGE_CLASS=""
+TOLERATIONS=()
+REPLICATOR_ENVS=()
+TOLERATION_FORMAT='^[^=:]+(=[^:]*)?(:(NoSchedule|PreferNoSchedule|NoExecute))?$'
+FORCE=0
+TEMP_DIR="${TMPDIR:-/tmp}"
+VERBOSE_COMMANDS=0
+KUBE_EXTRA_ARGS=()
+REQUIRE_TLS_VERIFY=0
+REPORT_FILE=""
+PROGRESS="text"
+PHASES_DONE=0
+LAST_ERROR=""
+ALL_VMS=0
+EXCLUDE_VMS=()
+VM_SELECTOR=""
+MAX_RETRIES_PER_VM=0
 
+strip_batch_args "$@"
 while [[ $# -gt 0 ]]; do
     case "$1" in
         --vm-name)
@@ -30,6 +1027,14 @@ while [[ $# -gt 0 ]]; do
             export VM_NAME
             shift 2
             ;;
+        --vm-uid)
+            VM_UID="$2"
+            shift 2
+            ;;
+        --vm-file)
+            VM_FILE="$2"
+            shift 2
+            ;;
         --namespace)
             NAMESPACE="$2"
             export NAMESPACE
@@ -45,8 +1050,230 @@ while [[ $# -gt 0 ]]; do
             export DST_KUBECONFIG
             shift 2
             ;;
+        --only)
+            ONLY_PHASES="$2"
+            shift 2
+            ;;
+        --skip)
+            SKIP_PHASES="$2"
+            shift 2
+            ;;
+        --no-cleanup-on-signal)
+            CLEANUP_ON_SIGNAL=0
+            shift
+            ;;
+        --cleanup-on-failure)
+            CLEANUP_ON_FAILURE=1
+            shift
+            ;;
+        --network-map)
+            if [[ "$2" != ?*=?* ]]; then
+                echo "Error: --network-map must be in the form <src>=<dst>."
+                usage
+            fi
+            NETWORK_MAPS+=("$2")
+            shift 2
+            ;;
+        --replicator-termination-grace-period)
+            REPLICATOR_GRACE_PERIOD="$2"
+            shift 2
+            ;;
+        --replicator-ttl)
+            REPLICATOR_TTL="$2"
+            shift 2
+            ;;
+        --replicator-cpu)
+            REPLICATOR_CPU="$2"
+            export REPLICATOR_CPU
+            shift 2
+            ;;
+        --replicator-memory)
+            REPLICATOR_MEMORY="$2"
+            export REPLICATOR_MEMORY
+            shift 2
+            ;;
+        --toleration)
+            if [[ ! "$2" =~ $TOLERATION_FORMAT ]]; then
+                echo "Error: --toleration must be in the form key[=value][:NoSchedule|PreferNoSchedule|NoExecute]."
+                usage
+            fi
+            TOLERATIONS+=("$2")
+            shift 2
+            ;;
+        --replicator-env)
+            if [[ ! "$2" =~ ^[A-Za-z_][A-Za-z0-9_]*= ]]; then
+                echo "Error: --replicator-env must be in the form NAME=value."
+                usage
+            fi
+            REPLICATOR_ENVS+=("$2")
+            shift 2
+            ;;
+        --all-vms)
+            ALL_VMS=1
+            shift
+            ;;
+        --exclude-vm)
+            EXCLUDE_VMS+=("$2")
+            shift 2
+            ;;
+        --vm-selector)
+            VM_SELECTOR="$2"
+            shift 2
+            ;;
+        --max-retries-per-vm)
+            if [[ ! "$2" =~ ^[0-9]+$ ]]; then
+                echo "Error: --max-retries-per-vm must be a non-negative number."
+                usage
+            fi
+            MAX_RETRIES_PER_VM="$2"
+            shift 2
+            ;;
+        --sync-script)
+            SYNC_SCRIPT="$2"
+            shift 2
+            ;;
+        --ssh-cipher)
+            SSH_CIPHER="$2"
+            shift 2
+            ;;
+        --report-file)
+            REPORT_FILE="$2"
+            shift 2
+            ;;
+        --progress)
+            PROGRESS="$2"
+            shift 2
+            ;;
+        --allow-pvc-expansion)
+            ALLOW_PVC_EXPANSION=1
+            shift
+            ;;
+        --force)
+            FORCE=1
+            shift
+            ;;
+        --temp-dir)
+            TEMP_DIR="$2"
+            shift 2
+            ;;
+        --verbose-commands)
+            VERBOSE_COMMANDS=1
+            shift
+            ;;
+        --require-tls-verify)
+            REQUIRE_TLS_VERIFY=1
+            shift
+            ;;
+        --kube-extra-arg)
+            if [[ "$2" != -* ]]; then
+                echo "Error: --kube-extra-arg must be a flag, with its value after '=' (e.g. --as=admin)."
+                usage
+            fi
+            KUBE_EXTRA_ARGS+=("$2")
+            shift 2
+            ;;
+        --strip-annotations)
+            STRIP_ANNOTATIONS="$2"
+            shift 2
+            ;;
+        --keep-annotations)
+            KEEP_ANNOTATIONS="$2"
+            shift 2
+            ;;
+        --replicator-ready-cmd)
+            REPLICATOR_READY_CMD="$2"
+            shift 2
+            ;;
+        --replicator-capabilities)
+            REPLICATOR_CAPABILITIES="$2"
+            export REPLICATOR_CAPABILITIES
+            shift 2
+            ;;
+        --replicator-seccomp)
+            REPLICATOR_SECCOMP="$2"
+            export REPLICATOR_SECCOMP
+            shift 2
+            ;;
+        --replicator-pull-secret)
+            REPLICATOR_PULL_SECRET="$2"
+            export REPLICATOR_PULL_SECRET
+            shift 2
+            ;;
+        --compress-transfer)
+            COMPRESS_TRANSFER=1
+            shift
+            ;;
+        --copy-provider)
+            COPY_PROVIDER="$2"
+            shift 2
+            ;;
+        --disk-image-name)
+            DISK_IMAGE="$2"
+            shift 2
+            ;;
+        --mount-timeout)
+            MOUNT_TIMEOUT="$2"
+            shift 2
+            ;;
+        --data-volume-size)
+            DATA_VOLUME_SIZE="$2"
+            export DATA_VOLUME_SIZE
+            shift 2
+            ;;
+        --data-storage-class)
+            DATA_STORAGE_CLASS="$2"
+            export DATA_STORAGE_CLASS
+            shift 2
+            ;;
+        --skip-persistent-state)
+            SKIP_PERSISTENT_STATE=1
+            shift
+            ;;
+        --copy-referenced-resources)
+            COPY_REFERENCED_RESOURCES=1
+            shift
+            ;;
+        --copy-instancetypes)
+            COPY_INSTANCETYPES=1
+            shift
+            ;;
+        --rotate-ssh-keys)
+            ROTATE_SSH_KEYS=1
+            shift
+            ;;
+        --schedule-timezone)
+            SCHEDULE_TIMEZONE="$2"
+            export SCHEDULE_TIMEZONE
+            shift 2
+            ;;
+        --sync-log-size)
+            SYNC_LOG_SIZE="$2"
+            export SYNC_LOG_SIZE
+            shift 2
+            ;;
+        --ca-bundle)
+            CA_BUNDLE="$2"
+            shift 2
+            ;;
+        --proxy)
+            PROXY="$2"
+            export PROXY
+            shift 2
+            ;;
+        --dst-vm-patch)
+            DST_VM_PATCH="$2"
+            shift 2
+            ;;
+        --export-only)
+            EXPORT_ONLY=1
+            shift
+            ;;
+        --output-dir)
+            OUTPUT_DIR="$2"
+            shift 2
+            ;;
         --help)
-            usage
+            usage 0
             ;;
         *)
             echo "Unknown option: $1"
@@ -55,96 +1282,138 @@ while [[ $# -gt 0 ]]; do
     esac
 done
 
+for phase in ${ONLY_PHASES//,/ } ${SKIP_PHASES//,/ }; do
+    if [[ " $PHASES " != *" $phase "* ]]; then
+        echo "Error: unknown phase '$phase'."
+        usage
+    fi
+done
+
+if [[ -n "$VM_FILE" ]]; then
+    read_vm_file || usage
+fi
+
+if [[ $ALL_VMS -eq 1 ]]; then
+    if [[ -n "$VM_NAME" || -n "$VM_UID" || -z "$NAMESPACE" || -z "$SRC_KUBECONFIG" || -z "$DST_KUBECONFIG" ]]; then
+        echo "Error: --all-vms requires --namespace, --src-kubeconfig and --dst-kubeconfig and cannot be combined with --vm-name or --vm-uid."
+        usage
+    fi
+    if [[ $PROGRESS == "json" ]]; then
+        echo "Error: --progress json cannot be combined with --all-vms."
+        usage
+    fi
+    run_batch
+    exit $?
+elif [[ ${#EXCLUDE_VMS[@]} -gt 0 || -n "$VM_SELECTOR" || $MAX_RETRIES_PER_VM -gt 0 ]]; then
+    echo "Error: --exclude-vm, --vm-selector and --max-retries-per-vm can only be used with --all-vms."
+    usage
+fi
+
 if [[ -z "$VM_NAME" || -z "$NAMESPACE" || -z "$SRC_KUBECONFIG" || -z "$DST_KUBECONFIG" ]]; then
     echo "Error: --vm-name, --namespace, --src-kubeconfig, and --dst-kubeconfig are required."
     usage
+elif [[ ! "$VM_NAME" =~ $DNS1123_SUBDOMAIN || ${#VM_NAME} -gt 253 ]]; then
+    echo "Error: --vm-name must be a valid DNS-1123 subdomain (lowercase alphanumerics, '-' and '.')."
+    usage
+elif [[ ! "$NAMESPACE" =~ $DNS1123_LABEL || ${#NAMESPACE} -gt 63 ]]; then
+    echo "Error: --namespace must be a valid DNS-1123 label (lowercase alphanumerics and '-', at most 63 characters)."
+    usage
+elif [[ $EXPORT_ONLY -eq 1 && -z "$OUTPUT_DIR" ]]; then
+    echo "Error: --export-only requires --output-dir."
+    usage
+elif [[ -n "$DATA_STORAGE_CLASS" && -z "$DATA_VOLUME_SIZE" ]]; then
+    echo "Error: --data-storage-class requires --data-volume-size."
+    usage
+elif [[ " $COPY_PROVIDERS " != *" $COPY_PROVIDER "* ]]; then
+    echo "Error: unsupported --copy-provider $COPY_PROVIDER, expected one of: $COPY_PROVIDERS"
+    usage
+elif [[ ! "$DISK_IMAGE" =~ ^[A-Za-z0-9_][A-Za-z0-9._-]*$ ]]; then
+    echo "Error: --disk-image-name must be a plain file name such as disk.img."
+    usage
+elif [[ -n "$REPLICATOR_TTL" && ! "$REPLICATOR_TTL" =~ ^[1-9][0-9]*$ ]]; then
+    echo "Error: --replicator-ttl must be a positive number of seconds."
+    usage
+elif [[ -n "$REPLICATOR_GRACE_PERIOD" && ! "$REPLICATOR_GRACE_PERIOD" =~ ^[0-9]+$ ]]; then
+    echo "Error: --replicator-termination-grace-period must be a number of seconds."
+    usage
+elif [[ ! "$MOUNT_TIMEOUT" =~ ^[1-9][0-9]*$ ]]; then
+    echo "Error: --mount-timeout must be a positive number of seconds."
+    usage
+elif [[ -n "$SSH_CIPHER" && " $SSH_CIPHERS " != *" $SSH_CIPHER "* ]]; then
+    echo "Error: unsupported --ssh-cipher $SSH_CIPHER, expected one of: $SSH_CIPHERS"
+    usage
+elif [[ -n "$REPLICATOR_CAPABILITIES" && ! "$REPLICATOR_CAPABILITIES" =~ ^[A-Z_]+(,[A-Z_]+)*$ ]]; then
+    echo "Error: --replicator-capabilities must be a comma separated list such as SYS_ADMIN,MKNOD."
+    usage
+elif [[ -n "$REPLICATOR_SECCOMP" && "$REPLICATOR_SECCOMP" != "RuntimeDefault" && "$REPLICATOR_SECCOMP" != "Unconfined" && "$REPLICATOR_SECCOMP" != Localhost/?* ]]; then
+    echo "Error: --replicator-seccomp must be RuntimeDefault, Unconfined or Localhost/<profile>."
+    usage
+elif [[ -n "$SCHEDULE_TIMEZONE" && ( ! -f /usr/share/zoneinfo/$SCHEDULE_TIMEZONE || "$SCHEDULE_TIMEZONE" == *..* ) ]]; then
+    echo "Error: unknown --schedule-timezone $SCHEDULE_TIMEZONE, expected an IANA time zone such as Europe/Istanbul."
+    usage
+elif [[ -n "$PROXY" && ! "$PROXY" =~ ^https?://[^/]+ ]]; then
+    echo "Error: --proxy must be an http:// or https:// URL."
+    usage
+elif [[ -n "$CA_BUNDLE" && ( ! -r "$CA_BUNDLE" || $(<"$CA_BUNDLE") != *"-----BEGIN CERTIFICATE-----"* ) ]]; then
+    echo "Error: --ca-bundle must be a readable file with PEM certificates."
+    usage
+elif [[ -n "$DST_VM_PATCH" && ( ! -r "$DST_VM_PATCH" || $(yq e 'tag' "$DST_VM_PATCH" 2>/dev/null) != "!!map" ) ]]; then
+    echo "Error: --dst-vm-patch must be a readable YAML file containing a mapping."
+    usage
+elif [[ -n "$SYNC_SCRIPT" && ! -r "$SYNC_SCRIPT" ]]; then
+    echo "Error: --sync-script $SYNC_SCRIPT is not readable."
+    usage
+elif [[ -n "$SYNC_SCRIPT" && ( $(<"$SYNC_SCRIPT") != *'${NODE_PORT}'* || $(<"$SYNC_SCRIPT") != *'${HOST_IP}'* ) ]]; then
+    echo "Error: --sync-script must use the \${NODE_PORT} and \${HOST_IP} placeholders."
+    usage
+elif [[ ! -d "$TEMP_DIR" || ! -w "$TEMP_DIR" ]]; then
+    echo "Error: --temp-dir $TEMP_DIR is not a writable directory."
+    usage
+elif [[ $PROGRESS != "text" && $PROGRESS != "json" ]]; then
+    echo "Error: --progress must be text or json."
+    usage
 else
-    echo "Checking source VM status"
-    src_vm_state=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --no-headers | awk '{print $3}'`
-    if [[ $? -eq 0 ]]; then echo $src_vm_state; else echo "No Running VM" ; fi
-    
-    echo "Checking destination VM status"
-    dst_vm_state=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}'`
-    if [[ $? -eq 0 ]]; then echo $dst_vm_state; else echo "No Running VM"; fi
-
-    if [[ $dst_vm_state != "Stopped" ]]; then
-        if [[ $dst_vm_state == "" ]]; then
-            echo "Exporting VM from source cluster"
-            oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o yaml > $VM_NAME-vm.yaml
-            if [[ $PRESERVE_POD_IP -eq 1 ]]; then
-                POD_IP=`oc get vmi $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.status.interfaces[0].ipAddress}'`"/23"
-                POD_MAC=`oc get vmi $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.status.interfaces[0].mac}'`
-                export ip_annotation="'{\"default\":{\"ip_address\":\"$POD_IP \",\"mac_address\":\"$POD_MAC\"}}'"
-                yq e -i '.spec.template.metadata.annotations["k8s.ovn.org/pod-networks"] = env(ip_annotation)' $VM_NAME-vm.yaml
-            fi
-            yq e -i '.spec.running = false' $VM_NAME-vm.yaml
-            oc apply --wait -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f $VM_NAME-vm.yaml
-            echo "Waiting for the destination VM to be created ...... "
-            while [[ $( oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}') != "Stopped"  ]]
-            do
-                printf  "#"
-                sleep 5
-            done
-        fi
-        if [[ $dst_vm_state == "Running" ]]; then
-            virtctl stop $VM_NAME --kubeconfig $DST_KUBECONFIG
-        fi
+    if [[ $PROGRESS == "json" ]]; then
+        exec 3>&1 1>&2
+        add_exit_hook progress_finished
     fi
-    
-    echo "Checking source Replicator"
-    src_repl_state=`oc get po $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --no-headers | awk '{print $3}' | grep -v "NotFound"`
-    if [[ $? -eq 0 ]]; then echo $src_repl_state; else echo "No Running Replicator" ; fi
-    
-    echo "Checking destination Replicator"
-    dst_repl_state=`oc get po $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}' | grep -v "NotFound"`
-    if [[ $? -eq 0 ]]; then echo $dst_repl_state; else echo "No Running Replicator" ; fi
-
-    if [[ $src_repl_state != "Running" ]]; then 
-        echo "Creating source Replicator"
-        yq -i '.metadata.name = strenv(VM_NAME)+"-src-replicator"' manifests/src-repl.yaml
-        yq e -i '.metadata.labels.app = env(VM_NAME)+"-src-replicator"' manifests/src-repl.yaml
-        yq e -i '.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' manifests/src-repl.yaml
-        oc apply --wait -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -f manifests/src-repl.yaml 
-        oc wait pod $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --for=condition=Ready --timeout=-1m
-        echo "Generating source replicator SSH key"
-        oc exec $VM_NAME-src-replicator -ti -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- bash -c "ssh-keygen -t rsa -b 4096 -N '' -f ~/.ssh/id_rsa"
-        echo "Generating source SSH secret"
-        oc cp $VM_NAME-src-replicator:/root/.ssh/id_rsa id_rsa -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
-        oc cp $VM_NAME-src-replicator:/root/.ssh/id_rsa.pub id_rsa.pub -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
-        oc create secret generic $VM_NAME-repl-ssh-keys --from-file=id_rsa --from-file=id_rsa.pub -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
-        src_repl_state=`oc get po $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --no-headers | awk '{print $3}' | grep -v "NotFound"`
+    if [[ -n $REPORT_FILE ]]; then
+        add_exit_hook write_report
     fi
-
-    if [[ $dst_repl_state != "Running" ]]; then 
-        echo "Creating destination Replicator"
-        yq e -i '.metadata.name = env(VM_NAME)+"-dst-replicator"' manifests/dst-repl.yaml
-        yq e -i '.metadata.labels.app = env(VM_NAME)+"-dst-replicator"' manifests/dst-repl.yaml
-        yq e -i '.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' manifests/dst-repl.yaml
-        oc apply --wait -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f manifests/dst-repl.yaml
-        yq e -i '.metadata.name = env(VM_NAME)+"-dst-svc"' manifests/dst-repl-svc.yaml
-        yq e -i '.metadata.labels.app = env(VM_NAME)+"-dst-replicator"' manifests/dst-repl-svc.yaml
-        yq e -i '.spec.selector.app = env(VM_NAME)+"-dst-replicator"' manifests/dst-repl-svc.yaml
-        oc wait pod $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --for=condition=Ready --timeout=-1m
-        oc apply -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f manifests/dst-repl-svc.yaml
-        src_ssh_key=`oc exec $VM_NAME-src-replicator -ti -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- bash -c "cat ~/.ssh/id_rsa.pub"`
-        oc exec $VM_NAME-dst-replicator -ti -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -- bash -c "mkdir ~/.ssh; echo '$src_ssh_key' > ~/.ssh/authorized_keys; chmod 600 ~/.ssh/authorized_keys"
-        dst_repl_state=`oc get po $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}' | grep -v "NotFound"`
-    fi
-
-    if [ $src_repl_state == "Running" -a $dst_repl_state == "Running" ]; then 
-        echo "Getting destination NodePort"
-        dst_node_port=`oc get svc $VM_NAME-dst-svc -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.spec.ports[0].nodePort}'`
-        export DST_NODE_PORT=$dst_node_port
-        echo "Getting destination Host IP"
-        dst_host_ip=`oc get po $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.status.hostIP}'`
-        export DST_HOST_IP=$dst_host_ip
-        echo "Starting initial volume replication"
-        oc exec $VM_NAME-src-replicator -ti -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- /bin/bash -c "mkdir /data/dimg; sshfs -o StrictHostKeyChecking=no -o port=$dst_node_port $dst_host_ip:/data/simg /data/dimg; cp -p --sparse=always /data/simg/disk.img /data/dimg/ & progress -m"
-        echo "Creating CronJob for async replication"
-        yq e -i '.metadata.name = env(VM_NAME)+"-repl-cronjob"' manifests/src-cronjob.yaml
-        yq e -i '.spec.jobTemplate.spec.template.spec.containers[0].command[2]="mkdir /data/dimg /data/dfs /data/sfs/; sshfs -o StrictHostKeyChecking=no -o port="+env(DST_NODE_PORT)+" "+ env(DST_HOST_IP)+":/data/simg /data/dimg; guestmount -a /data/simg/disk.img -m /dev/sda4 --ro /data/sfs; guestmount -a /data/dimg/disk.img -m /dev/sda4 --rw /data/dfs; rclone sync --progress /data/sfs/ /data/dfs/ --skip-links --checkers 8 --contimeout 100s --timeout 300s --retries 3 --low-level-retries 10 --drive-acknowledge-abuse --stats 1s --cutoff-mode=soft; sleep 20"' manifests/src-cronjob.yaml;
-        yq e -i '.spec.jobTemplate.spec.template.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' manifests/src-cronjob.yaml
-        yq e -i '.spec.jobTemplate.spec.template.spec.volumes[1].secret.secretName = env(VM_NAME)+"-repl-ssh-keys"' manifests/src-cronjob.yaml
-        oc apply -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -f manifests/src-cronjob.yaml
+    make_work_dir || exit 1
+    check_tls_verify $SRC_KUBECONFIG source || exit $EXIT_CLUSTER
+    check_tls_verify $DST_KUBECONFIG destination || exit $EXIT_CLUSTER
+    check_kubevirt $SRC_KUBECONFIG source || exit $EXIT_CLUSTER
+    check_vm_uid || exit 1
+    if [[ $EXPORT_ONLY -eq 1 ]]; then
+        mkdir -p $OUTPUT_DIR
+        export_vm $OUTPUT_DIR/$VM_NAME.yaml || exit 1
+        echo "VM definition written to $OUTPUT_DIR/$VM_NAME.yaml"
+        exit 0
     fi
+    check_kubevirt $DST_KUBECONFIG destination || exit $EXIT_CLUSTER
+    trap on_signal INT TERM
+    acquire_lock || exit $?
+    for phase in $PHASES; do
+        if ! phase_enabled $phase; then
+            echo "Skipping phase $phase"
+            PHASES_DONE=$((PHASES_DONE + 1))
+            progress_event phase_skipped $phase
+            continue
+        fi
+        echo "Running phase $phase"
+        progress_event phase_started $phase
+        if ! phase_${phase//-/_}; then
+            LAST_ERROR="phase $phase failed"
+            echo "Error: $LAST_ERROR."
+            progress_event phase_failed $phase
+            if [[ $CLEANUP_ON_FAILURE -eq 1 ]]; then
+                echo "Cleaning up resources created by this run"
+                cleanup_created_resources
+            fi
+            exit 1
+        fi
+        PHASES_DONE=$((PHASES_DONE + 1))
+        progress_event phase_completed $phase
+    done
 fi
\ No newline at end of file
@@ -0,0 +1,76 @@
+#!/bin/bash
+# Batch migration support shared by init.sh and migrate.sh. The sourcing
+# script calls strip_batch_args with its command line before parsing it, and
+# run_batch re-runs the script once per VM with --vm-name set.
+
+# Stores the command line without the batch flags in BATCH_ARGS.
+strip_batch_args() {
+    BATCH_ARGS=()
+    while [[ $# -gt 0 ]]; do
+        case "$1" in
+            --all-vms)
+                shift
+                ;;
+            --exclude-vm|--vm-selector|--report-file|--max-retries-per-vm)
+                shift 2
+                ;;
+            *)
+                BATCH_ARGS+=("$1")
+                shift
+                ;;
+        esac
+    done
+}
+
+# Runs the calling script for every VM in the source namespace matching
+# VM_SELECTOR and not listed in EXCLUDE_VMS, retrying a failed run up to
+# MAX_RETRIES_PER_VM times. Prints a summary of all VMs and fails if any of
+# them failed.
+run_batch() {
+    local vms selector=() report results=() failed=0 status attempt
+    if [[ -n $VM_SELECTOR ]]; then
+        selector=(-l "$VM_SELECTOR")
+    fi
+    check_kubevirt $SRC_KUBECONFIG source || return $EXIT_CLUSTER
+    vms=`oc get vm -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG "${selector[@]}" -o name` || return 1
+    for vm in $vms; do
+        vm=${vm##*/}
+        if [[ " ${EXCLUDE_VMS[*]} " == *" $vm "* ]]; then
+            echo "Skipping excluded VM $vm"
+            results+=("$vm skipped excluded")
+            continue
+        fi
+        report=()
+        if [[ -n $REPORT_FILE ]]; then
+            report=(--report-file "${REPORT_FILE%.json}-$vm.json")
+        fi
+        for ((attempt=1; attempt<=MAX_RETRIES_PER_VM+1; attempt++)); do
+            echo "Processing VM $vm (attempt $attempt/$((MAX_RETRIES_PER_VM + 1)))"
+            bash "$0" "${BATCH_ARGS[@]}" "${report[@]}" --vm-name $vm
+            status=$?
+            if [[ $status -eq 0 ]]; then
+                break
+            fi
+        done
+        if [[ $status -eq 0 ]]; then
+            results+=("$vm success attempts=$attempt")
+        else
+            results+=("$vm failed exit-status=$status,attempts=$((attempt - 1))")
+            failed=$((failed + 1))
+        fi
+    done
+    print_batch_summary "${results[@]}"
+    if [[ $failed -gt 0 ]]; then
+        echo "Error: $failed VM(s) failed."
+        return 1
+    fi
+}
+
+# Prints one "<vm> <result> <details>" line per VM as a table.
+print_batch_summary() {
+    echo
+    printf "%-40s %-8s %s\n" VM RESULT DETAILS
+    for result in "$@"; do
+        printf "%-40s %-8s %s\n" $result
+    done
+}
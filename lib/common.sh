@@ -0,0 +1,296 @@
+#!/bin/bash
+# Helpers shared by the scripts.
+
+EXIT_HOOKS=()
+
+# Exit statuses for the failure categories callers may want to tell apart.
+# Other failures exit with 1.
+EXIT_USAGE=2     # invalid or missing flags
+EXIT_CLUSTER=3   # a cluster misses a prerequisite, such as KubeVirt
+EXIT_CUTOVER=4   # migrate.sh failed after stopping the source VM
+
+# Label carried by every replication resource the scripts create. migrate.sh
+# only cleans up resources that carry it.
+MANAGED_BY_LABEL="app.kubernetes.io/managed-by=kubevirt-migrator"
+
+# Kubernetes object name syntax, used to validate --vm-name, and namespace
+# name syntax, used to validate --namespace. Both also apply to the values
+# read from --vm-file.
+DNS1123_SUBDOMAIN='^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$'
+DNS1123_LABEL='^[a-z0-9]([-a-z0-9]*[a-z0-9])?$'
+
+# Container waiting reasons that mean a pod will not become Ready on its own.
+POD_FAILURE_REASONS="CrashLoopBackOff ImagePullBackOff ErrImagePull CreateContainerConfigError"
+
+# Registers a function to run when the script exits. Hooks run in reverse
+# registration order and can read the script's exit status from EXIT_STATUS.
+add_exit_hook() {
+    EXIT_HOOKS+=("$1")
+    trap run_exit_hooks EXIT
+}
+
+run_exit_hooks() {
+    EXIT_STATUS=$?
+    for ((i=${#EXIT_HOOKS[@]}-1; i>=0; i--)); do
+        ${EXIT_HOOKS[$i]}
+    done
+    exit $EXIT_STATUS
+}
+
+# Creates a private working directory under TEMP_DIR for the files a run
+# writes locally: the rendered manifests, the replicator SSH keys and the
+# exported VM. The manifest templates are copied into it, so the checkout is
+# never modified. The directory is removed when the script exits.
+make_work_dir() {
+    WORK_DIR=`mktemp -d "$TEMP_DIR/kubevirt-migrator.XXXXXX"` || return 1
+    add_exit_hook remove_work_dir
+    cp -r "$(dirname "$0")/manifests" $WORK_DIR/ || return 1
+}
+
+remove_work_dir() {
+    rm -rf $WORK_DIR
+}
+
+# Fills VM_NAME and NAMESPACE from the metadata of the --vm-file manifest,
+# keeping values already given with --vm-name and --namespace.
+read_vm_file() {
+    if [[ ! -r "$VM_FILE" || $(yq e '.kind' "$VM_FILE" 2>/dev/null) != "VirtualMachine" ]]; then
+        echo "Error: --vm-file must be a readable VirtualMachine manifest."
+        return 1
+    fi
+    if [[ -z $VM_NAME ]]; then
+        VM_NAME=`yq e '.metadata.name // ""' "$VM_FILE"`
+        export VM_NAME
+    fi
+    if [[ -z $NAMESPACE ]]; then
+        NAMESPACE=`yq e '.metadata.namespace // ""' "$VM_FILE"`
+        export NAMESPACE
+    fi
+}
+
+# Reports whether an oc error message describes a transient failure worth
+# retrying, such as an unreachable or overloaded API server, rather than a
+# permanent one such as Forbidden or an invalid request.
+is_retryable() {
+    case "$1" in
+        *"connection refused"*|*"connection reset"*|*"i/o timeout"*|*"TLS handshake timeout"*|*"timed out"*|*"unexpected EOF"*)
+            return 0
+            ;;
+        *"ServiceUnavailable"*|*"service unavailable"*|*"TooManyRequests"*|*"too many requests"*|*"etcdserver"*|*"InternalError"*)
+            return 0
+            ;;
+    esac
+    return 1
+}
+
+# Prints the arguments with kubeconfig paths and credentials replaced by
+# <redacted>.
+redact_args() {
+    local out=() redact_next=0
+    for arg in "$@"; do
+        if [[ $redact_next -eq 1 ]]; then
+            out+=("<redacted>")
+            redact_next=0
+            continue
+        fi
+        case "$arg" in
+            --kubeconfig|--token|--username|--password|--client-key|--client-certificate)
+                out+=("$arg")
+                redact_next=1
+                ;;
+            --kubeconfig=*|--token=*|--username=*|--password=*|--client-key=*|--client-certificate=*)
+                out+=("${arg%%=*}=<redacted>")
+                ;;
+            *)
+                out+=("$arg")
+                ;;
+        esac
+    done
+    echo "${out[*]}"
+}
+
+# Every oc and virtctl invocation gets the --kube-extra-arg flags, placed
+# before the subcommand so they never end up after an exec "--". With
+# --verbose-commands, the command is logged to stderr before it runs.
+oc() {
+    if [[ $VERBOSE_COMMANDS -eq 1 ]]; then
+        echo "+ oc `redact_args "${KUBE_EXTRA_ARGS[@]}" "$@"`" >&2
+    fi
+    command oc "${KUBE_EXTRA_ARGS[@]}" "$@"
+}
+
+virtctl() {
+    if [[ $VERBOSE_COMMANDS -eq 1 ]]; then
+        echo "+ virtctl `redact_args "${KUBE_EXTRA_ARGS[@]}" "$@"`" >&2
+    fi
+    command virtctl "${KUBE_EXTRA_ARGS[@]}" "$@"
+}
+
+# Prints the printable status of the VM (e.g. Running, Stopped) on the cluster
+# of the given kubeconfig, or nothing if the VM does not exist there.
+vm_status() {
+    oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $1 --ignore-not-found -o=jsonpath='{.status.printableStatus}'
+}
+
+# Fails with a clear message if KubeVirt is not installed on the cluster of
+# the given kubeconfig, which oc only reports as a missing "vm" resource
+# type, or if the cluster cannot be reached or rejects the credentials. The
+# second argument names the cluster in the message. Returns $EXIT_CLUSTER.
+check_kubevirt() {
+    local err
+    err=`oc get vm -n $NAMESPACE --kubeconfig $1 -o name 2>&1 >/dev/null`
+    case "$err" in
+        *"doesn't have a resource type"*)
+            echo "Error: KubeVirt does not appear to be installed on the $2 cluster."
+            return $EXIT_CLUSTER
+            ;;
+        *"Unauthorized"*|*"must be logged in"*|*"no such host"*|*"x509"*)
+            echo "Error: could not access the $2 cluster: $err"
+            return $EXIT_CLUSTER
+            ;;
+    esac
+    if [[ -n $err ]] && is_retryable "$err"; then
+        echo "Error: could not reach the $2 cluster: $err"
+        return $EXIT_CLUSTER
+    fi
+}
+
+# Warns when TLS verification of the API server is disabled for the cluster of
+# the given kubeconfig, by the kubeconfig or by --kube-extra-arg, and fails
+# instead with --require-tls-verify. The second argument names the cluster in
+# the message.
+check_tls_verify() {
+    local insecure arg
+    insecure=`oc config view --minify --kubeconfig $1 -o=jsonpath='{.clusters[0].cluster.insecure-skip-tls-verify}'`
+    for arg in "${KUBE_EXTRA_ARGS[@]}"; do
+        case "$arg" in
+            --insecure-skip-tls-verify|--insecure-skip-tls-verify=true)
+                insecure=true
+                ;;
+        esac
+    done
+    if [[ $insecure != "true" ]]; then
+        return 0
+    fi
+    if [[ $REQUIRE_TLS_VERIFY -eq 1 ]]; then
+        echo "Error: TLS verification is disabled for the $2 cluster (insecure-skip-tls-verify)."
+        return 1
+    fi
+    echo "Warning: TLS verification is disabled for the $2 cluster (insecure-skip-tls-verify); its API server identity is not checked."
+}
+
+# Reports whether the VM exists on the cluster of the given kubeconfig.
+# Returns 2 if that cannot be determined, e.g. the API server is unreachable.
+vm_exists() {
+    local name
+    name=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $1 --ignore-not-found -o name` || return 2
+    [[ -n $name ]]
+}
+
+# Fails unless the source VM's metadata.uid matches --vm-uid, so a VM that was
+# deleted and recreated under the same name is not acted on by mistake. Does
+# nothing without --vm-uid.
+check_vm_uid() {
+    local uid
+    if [[ -z $VM_UID ]]; then
+        return 0
+    fi
+    uid=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.metadata.uid}'` || return 1
+    if [[ $uid != "$VM_UID" ]]; then
+        echo "Error: source VM $VM_NAME has uid $uid, not $VM_UID; it may have been deleted and recreated."
+        return 1
+    fi
+}
+
+# Succeeds when the VM on the cluster of the given kubeconfig has no
+# VirtualMachineInstance, so nothing holds its disks open, whatever its
+# printable status (Starting, Paused, Migrating, Stopping, ...). Returns 2 if
+# the instance cannot be read.
+vmi_absent() {
+    local vmi
+    vmi=`oc get vmi $VM_NAME -n $NAMESPACE --kubeconfig $1 --ignore-not-found -o name` || return 2
+    [[ -z $vmi ]]
+}
+
+# Reports whether the VM on the cluster of the given kubeconfig has the given
+# printable status.
+vm_status_is() {
+    [[ $(vm_status $1) == "$2" ]]
+}
+
+# Runs the given command every <interval> seconds until it succeeds. A
+# <timeout> of 0 waits forever. The command returns 1 to keep waiting; any
+# other non-zero status stops the wait and is returned as is. Returns 1 when
+# the timeout is reached.
+wait_for() {
+    local interval=$1 timeout=$2 waited=0 rc
+    shift 2
+    while true; do
+        "$@"
+        rc=$?
+        if [[ $rc -ne 1 ]]; then
+            return $rc
+        fi
+        if [[ $timeout -gt 0 && $waited -ge $timeout ]]; then
+            return 1
+        fi
+        sleep $interval
+        waited=$((waited + interval))
+    done
+}
+
+# Prints the phase of a pod, or the waiting reason of one of its containers
+# when it is stuck in a failure state such as CrashLoopBackOff. Prints nothing
+# if the pod does not exist.
+pod_status() {
+    local status=(`oc get po $1 -n $NAMESPACE --kubeconfig $2 --ignore-not-found -o=jsonpath='{.status.phase} {.status.initContainerStatuses[*].state.waiting.reason} {.status.containerStatuses[*].state.waiting.reason}'`)
+    for reason in "${status[@]:1}"; do
+        if [[ " $POD_FAILURE_REASONS " == *" $reason "* ]]; then
+            echo $reason
+            return
+        fi
+    done
+    echo ${status[0]}
+}
+
+# Waits for a pod to become Ready, failing fast when it enters a failure state,
+# terminates (e.g. --replicator-ttl's activeDeadlineSeconds or an eviction) or
+# is deleted.
+wait_for_pod() {
+    local state pod
+    while [[ $(oc get po $1 -n $NAMESPACE --kubeconfig $2 -o=jsonpath='{.status.conditions[?(@.type=="Ready")].status}') != "True" ]]
+    do
+        state=`pod_status $1 $2`
+        if [[ " $POD_FAILURE_REASONS " == *" $state "* ]]; then
+            echo "Error: pod $1 is in $state"
+            return 1
+        fi
+        case $state in
+            Failed|Succeeded)
+                echo "Error: pod $1 terminated with phase $state, see oc describe pod $1"
+                return 1
+                ;;
+            "")
+                if pod=`oc get po $1 -n $NAMESPACE --kubeconfig $2 --ignore-not-found -o name` && [[ -z $pod ]]; then
+                    echo "Error: pod $1 no longer exists"
+                    return 1
+                fi
+                ;;
+        esac
+        sleep 5
+    done
+}
+
+# Prints the names of the VM's running replication jobs: those started by the
+# cronjob and one-off jobs created from it, e.g. by sync.sh, which the cronjob
+# does not list in .status.active. Fails if the jobs cannot be read.
+active_replication_jobs() {
+    local jobs job active=()
+    jobs=`oc get jobs -l $MANAGED_BY_LABEL -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{range .items[?(@.status.active)]}{.metadata.name}{" "}{end}'` || return 1
+    for job in $jobs; do
+        if [[ $job == $VM_NAME-repl-* ]]; then
+            active+=($job)
+        fi
+    done
+    echo ${active[*]}
+}
@@ -0,0 +1,56 @@
+#!/bin/bash
+# Per-VM lock shared by init.sh, migrate.sh and sync.sh, so two runs cannot
+# replicate or cut over the same VM at once. The lock is an annotation on the
+# source VM. It is written with the resourceVersion read together with the
+# free lock, so the API server rejects the write with a conflict if another
+# run changed the VM in between.
+
+LOCK_ANNOTATION="migrator.kloia.io/lock"
+
+# Takes the lock. Returns 1 if another run holds it and $EXIT_CLUSTER if the
+# source cluster could not be read or written.
+acquire_lock() {
+    local lock holder out
+    LOCK_HOLDER="`hostname`.$$"
+    if ! out=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.metadata.resourceVersion} {.metadata.annotations.migrator\.kloia\.io/lock}' 2>&1`; then
+        lock_error "$out"
+        return $EXIT_CLUSTER
+    fi
+    lock=($out)
+    holder=${lock[1]}
+    if [[ -z $holder ]]; then
+        if out=`oc annotate vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --resource-version=${lock[0]} $LOCK_ANNOTATION=$LOCK_HOLDER 2>&1`; then
+            add_exit_hook release_lock
+            return 0
+        fi
+        case "$out" in
+            *"Conflict"*|*"the object has been modified"*|*"already has a value"*)
+                holder=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.metadata.annotations.migrator\.kloia\.io/lock}'`
+                ;;
+            *)
+                lock_error "$out"
+                return $EXIT_CLUSTER
+                ;;
+        esac
+    fi
+    echo "Error: could not lock VM $VM_NAME${holder:+, it is locked by $holder}."
+    echo "If no other run is active, remove the $LOCK_ANNOTATION annotation from the source VM."
+    return 1
+}
+
+# Reports an API error that kept the lock from being read or written.
+lock_error() {
+    if is_retryable "$1"; then
+        echo "Error: could not reach the source cluster to lock VM $VM_NAME: $1"
+    else
+        echo "Error: could not lock VM $VM_NAME: $1"
+    fi
+}
+
+# Removes the lock if it is still held by this run.
+release_lock() {
+    local holder=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.metadata.annotations.migrator\.kloia\.io/lock}'`
+    if [[ $holder == "$LOCK_HOLDER" ]]; then
+        oc annotate vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG $LOCK_ANNOTATION- > /dev/null
+    fi
+}
@@ -0,0 +1,37 @@
+#!/bin/bash
+# Migration report shared by init.sh and migrate.sh. When --report-file is
+# set, the sourcing script registers write_report as an exit hook so the report
+# is written whether the run succeeds or fails.
+
+REPORT_START=`date -u +%Y-%m-%dT%H:%M:%SZ`
+
+# Writes the JSON report for the current run to REPORT_FILE. LAST_ERROR, when
+# set by the script, is recorded as the failure reason.
+write_report() {
+    local status=$EXIT_STATUS
+    export REPORT_COMMAND=`basename $0 .sh`
+    export REPORT_END=`date -u +%Y-%m-%dT%H:%M:%SZ`
+    export REPORT_EXIT_CODE=$status
+    export REPORT_SUCCESS=false
+    export REPORT_ERROR=${LAST_ERROR:-}
+    export REPORT_SRC_CLUSTER=`oc config view --minify --kubeconfig $SRC_KUBECONFIG -o jsonpath='{.clusters[0].cluster.server}'`
+    export REPORT_DST_CLUSTER=`oc config view --minify --kubeconfig $DST_KUBECONFIG -o jsonpath='{.clusters[0].cluster.server}'`
+    export REPORT_START REPORT_SYNC_TOOL=${SYNC_TOOL:-}
+    if [[ $status -eq 0 ]]; then
+        REPORT_SUCCESS=true
+    elif [[ -z $REPORT_ERROR ]]; then
+        REPORT_ERROR="exited with status $status"
+    fi
+    yq -n -o json '.command = strenv(REPORT_COMMAND) |
+        .vm = strenv(VM_NAME) |
+        .namespace = strenv(NAMESPACE) |
+        .sourceCluster = strenv(REPORT_SRC_CLUSTER) |
+        .destinationCluster = strenv(REPORT_DST_CLUSTER) |
+        .startTime = strenv(REPORT_START) |
+        .endTime = strenv(REPORT_END) |
+        .syncTool = strenv(REPORT_SYNC_TOOL) |
+        .success = env(REPORT_SUCCESS) |
+        .exitCode = env(REPORT_EXIT_CODE) |
+        .error = strenv(REPORT_ERROR)' > $REPORT_FILE
+    echo "Report written to $REPORT_FILE"
+}
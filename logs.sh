@@ -0,0 +1,113 @@
+#!/bin/bash
+
+source "$(dirname "$0")/lib/common.sh"
+
+usage() {
+    echo "Usage: $0 --vm-name <vm-name> --namespace <namespace> --src-kubeconfig <file> [options]"
+    echo
+    echo "Prints the latest sync log kept by init.sh --sync-log-size."
+    echo
+    echo "Options:"
+    echo "  --vm-name           Virtual machine name (required)"
+    echo "  --namespace         Kubernetes namespace (required)"
+    echo "  --src-kubeconfig    Source kubeconfig file path (required)"
+    echo "  --temp-dir          Directory for the rendered reader pod manifest (optional, default \$TMPDIR or /tmp)"
+    echo "  --verbose-commands  Log every oc and virtctl command, with kubeconfig paths redacted (optional)"
+    echo "  --kube-extra-arg    Global flag added to every oc and virtctl command, e.g. --request-timeout=30s (optional, repeatable)"
+    echo "  --help              Display this help message and exit"
+    exit ${1:-$EXIT_USAGE}
+}
+
+# Succeeds once the reader pod has terminated.
+reader_done() {
+    local phase
+    phase=`oc get po $VM_NAME-repl-logs-reader -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.status.phase}'` || return 2
+    [[ $phase == "Succeeded" || $phase == "Failed" ]]
+}
+
+# Deletes the reader pod.
+delete_reader() {
+    oc delete po $VM_NAME-repl-logs-reader -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --ignore-not-found --wait > /dev/null
+}
+
+VM_NAME=""
+NAMESPACE=""
+SRC_KUBECONFIG=""
+READER_TIMEOUT=300
+TEMP_DIR="${TMPDIR:-/tmp}"
+VERBOSE_COMMANDS=0
+KUBE_EXTRA_ARGS=()
+
+while [[ $# -gt 0 ]]; do
+    case "$1" in
+        --vm-name)
+            VM_NAME="$2"
+            export VM_NAME
+            shift 2
+            ;;
+        --namespace)
+            NAMESPACE="$2"
+            shift 2
+            ;;
+        --src-kubeconfig)
+            SRC_KUBECONFIG="$2"
+            shift 2
+            ;;
+        --temp-dir)
+            TEMP_DIR="$2"
+            shift 2
+            ;;
+        --verbose-commands)
+            VERBOSE_COMMANDS=1
+            shift
+            ;;
+        --kube-extra-arg)
+            if [[ "$2" != -* ]]; then
+                echo "Error: --kube-extra-arg must be a flag, with its value after '=' (e.g. --as=admin)."
+                usage
+            fi
+            KUBE_EXTRA_ARGS+=("$2")
+            shift 2
+            ;;
+        --help)
+            usage 0
+            ;;
+        *)
+            echo "Unknown option: $1"
+            usage
+            ;;
+    esac
+done
+
+if [[ -z "$VM_NAME" || -z "$NAMESPACE" || -z "$SRC_KUBECONFIG" ]]; then
+    echo "Error: --vm-name, --namespace and --src-kubeconfig are required."
+    usage
+elif [[ ! "$VM_NAME" =~ $DNS1123_SUBDOMAIN || ${#VM_NAME} -gt 253 ]]; then
+    echo "Error: --vm-name must be a valid DNS-1123 subdomain (lowercase alphanumerics, '-' and '.')."
+    usage
+elif [[ ! "$NAMESPACE" =~ $DNS1123_LABEL || ${#NAMESPACE} -gt 63 ]]; then
+    echo "Error: --namespace must be a valid DNS-1123 label (lowercase alphanumerics and '-', at most 63 characters)."
+    usage
+elif [[ ! -d "$TEMP_DIR" || ! -w "$TEMP_DIR" ]]; then
+    echo "Error: --temp-dir $TEMP_DIR is not a writable directory."
+    usage
+else
+    if [[ -z $(oc get pvc $VM_NAME-repl-logs -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --ignore-not-found -o name) ]]; then
+        echo "Error: no sync log PVC $VM_NAME-repl-logs. Run init.sh with --sync-log-size to keep sync logs."
+        exit 1
+    fi
+    make_work_dir || exit 1
+
+    # The PVC is ReadWriteOnce, so the reader may wait until a running sync
+    # job on another node has released it.
+    yq e -i '.metadata.name = env(VM_NAME)+"-repl-logs-reader"' $WORK_DIR/manifests/src-sync-logs-reader.yaml
+    yq e -i '.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)+"-repl-logs"' $WORK_DIR/manifests/src-sync-logs-reader.yaml
+    delete_reader
+    oc apply -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -f $WORK_DIR/manifests/src-sync-logs-reader.yaml > /dev/null || exit 1
+    add_exit_hook delete_reader
+    if ! wait_for 2 $READER_TIMEOUT reader_done; then
+        echo "Error: could not read the sync logs within ${READER_TIMEOUT}s, see oc describe pod $VM_NAME-repl-logs-reader."
+        exit 1
+    fi
+    oc logs $VM_NAME-repl-logs-reader -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
+fi
\ No newline at end of file
@@ -1,24 +1,269 @@
 #!/bin/bash
 
+source "$(dirname "$0")/lib/common.sh"
+source "$(dirname "$0")/lib/batch.sh"
+source "$(dirname "$0")/lib/lock.sh"
+source "$(dirname "$0")/lib/report.sh"
+
 usage() {
-    echo "Usage: $0 --vm-name <vm-name> --namespace <namespace> --src-kubeconfig <file> --dst-kubeconfig <file> [--verbose] [--help]"
+    echo "Usage: $0 --vm-name <vm-name> --namespace <namespace> --src-kubeconfig <file> --dst-kubeconfig <file> [options]"
     echo
     echo "Options:"
-    echo "  --vm-name           Virtual machine name (required)"
+    echo "  --vm-name           Virtual machine name (required unless --all-vms)"
+    echo "  --vm-uid            Expected metadata.uid of the source VM (optional)"
+    echo "  --vm-file           VirtualMachine manifest to take --vm-name and --namespace from (optional)"
     echo "  --namespace         Namespace to work on (required)"
     echo "  --src-kubeconfig    Source kubeconfig file path (required)"
     echo "  --dst-kubeconfig    Destination kubeconfig file path (required)"
+    echo "  --cutover-only      Only perform the cutover, failing if init.sh has not completed (optional)"
+    echo "  --all-vms           Run for every VM in the source namespace (optional)"
+    echo "  --exclude-vm        VM to leave out of --all-vms (optional, repeatable)"
+    echo "  --vm-selector       Label selector restricting the VMs of --all-vms (optional)"
+    echo "  --max-retries-per-vm  Times a failed VM of --all-vms is retried (optional, default 0)"
+    echo "  --report-file       Write a JSON report of the run to this file (optional)"
+    echo "  --require-confirmation  Ask for approval on stdin before stopping the source VM (optional)"
+    echo "  --force-cleanup     Delete replication resources even if they lack the $MANAGED_BY_LABEL label (optional)"
+    echo "  --force             Stop a Running destination VM instead of refusing to continue (optional)"
+    echo "  --temp-dir          Directory for rendered manifests, SSH keys and the exported VM (optional, default \$TMPDIR or /tmp)"
+    echo "  --verbose-commands  Log every oc and virtctl command, with kubeconfig paths redacted (optional)"
+    echo "  --kube-extra-arg    Global flag added to every oc and virtctl command, e.g. --request-timeout=30s (optional, repeatable)"
+    echo "  --require-tls-verify  Fail instead of warning when a kubeconfig skips TLS verification (optional)"
+    echo "  --poll-interval     Seconds between VM and job status checks (optional, default 5)"
+    echo "  --dst-run-state     State of the destination VM after the cutover: running or stopped (optional, default running)"
+    echo "  --trim-after-cutover  Discard unused blocks of the destination disk with virt-sparsify before starting it (optional)"
+    echo "  --disk-image-name   File name of the disk image in the VM PVCs, for --trim-after-cutover (optional, default disk.img)"
+    echo "  --final-sync-timeout  Seconds to wait for the final replication job, 0 for no limit (optional, default 7200)"
     echo "  --help              Display this help message and exit"
-    exit 1
+    exit ${1:-$EXIT_USAGE}
+}
+
+# Verifies that init.sh completed for the VM: the replication cronjob, both
+# replicator pods and the destination VM must exist.
+verify_init_completed() {
+    local missing=()
+    if [[ -z $(oc get cronjob $VM_NAME-repl-cronjob -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --ignore-not-found -o name) ]]; then
+        missing+=("cronjob $VM_NAME-repl-cronjob on the source cluster")
+    fi
+    if [[ $(pod_status $VM_NAME-src-replicator $SRC_KUBECONFIG) != "Running" ]]; then
+        missing+=("running pod $VM_NAME-src-replicator on the source cluster")
+    fi
+    if [[ $(pod_status $VM_NAME-dst-replicator $DST_KUBECONFIG) != "Running" ]]; then
+        missing+=("running pod $VM_NAME-dst-replicator on the destination cluster")
+    fi
+    if ! vm_exists $DST_KUBECONFIG; then
+        missing+=("VM $VM_NAME on the destination cluster")
+    fi
+    if [[ ${#missing[@]} -gt 0 ]]; then
+        echo "Error: replication has not been initialized, missing:"
+        printf '  %s\n' "${missing[@]}"
+        echo "Run init.sh for this VM before running the cutover."
+        return 1
+    fi
+}
+
+# Waits for replication jobs started before the cronjob was suspended, so the
+# source VM is not stopped in the middle of an incremental sync.
+wait_for_active_jobs() {
+    wait_for $POLL_INTERVAL $ACTIVE_JOB_TIMEOUT no_active_jobs
+    case $? in
+        0)
+            ;;
+        1)
+            echo "Error: replication job(s) still running after ${ACTIVE_JOB_TIMEOUT}s"
+            return 1
+            ;;
+        *)
+            echo "Error: could not read the replication jobs of $VM_NAME"
+            return 1
+            ;;
+    esac
+}
+
+# Succeeds when no replication job of the VM is running. Returns 2 if the
+# jobs cannot be read.
+no_active_jobs() {
+    local active
+    active=`active_replication_jobs` || return 2
+    if [[ -n $active ]]; then
+        echo "Waiting for running replication job(s): $active"
+        return 1
+    fi
+}
+
+# Resumes the CronJob suspended for the cutover, when migrate.sh stops before
+# stopping the source VM.
+resume_cronjob() {
+    oc patch cronjob $VM_NAME-repl-cronjob -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -p '{"spec" : {"suspend" : false }}'
+}
+
+# Asks the operator to approve the cutover. Declining resumes the cronjob so
+# replication continues as before.
+confirm_cutover() {
+    local answer
+    read -r -p "Stop source VM $VM_NAME and cut over to the destination cluster? [y/N] " answer
+    if [[ $answer != [yY] && $answer != [yY][eE][sS] ]]; then
+        echo "Cutover declined, resuming CronJob"
+        resume_cronjob
+        return 1
+    fi
+}
+
+# Creates the final replication job from the cronjob. A final job left by an
+# earlier attempt is deleted first, and NotFound/Conflict errors seen right
+# after suspending the cronjob are retried with a growing delay.
+create_final_job() {
+    local err
+    for attempt in $(seq 1 $JOB_CREATE_RETRIES); do
+        if [[ -n $(oc get job $VM_NAME-repl-final-job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --ignore-not-found -o name) ]]; then
+            echo "Deleting stale final replication job"
+            oc delete job $VM_NAME-repl-final-job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --wait
+        fi
+        if { err=`oc create job --from=cronjob/$VM_NAME-repl-cronjob $VM_NAME-repl-final-job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG 2>&1 1>&3`; } 3>&1; then
+            return 0
+        fi
+        echo "Creating final replication job failed (attempt $attempt/$JOB_CREATE_RETRIES): $err"
+        case "$err" in
+            *AlreadyExists*|*NotFound*|*Conflict*)
+                ;;
+            *)
+                is_retryable "$err" || return 1
+                ;;
+        esac
+        sleep $((attempt * 5))
+    done
+    return 1
+}
+
+# Prints the oc wait --timeout for the final replication job. A
+# --final-sync-timeout of 0 waits without limit.
+final_sync_timeout() {
+    if [[ $FINAL_SYNC_TIMEOUT -eq 0 ]]; then
+        echo "-1s"
+        return
+    fi
+    echo "${FINAL_SYNC_TIMEOUT}s"
+}
+
+# Reports whether a resource is missing or carries MANAGED_BY_LABEL, i.e. it
+# is safe for the cleanup to delete it.
+is_managed() {
+    local kubeconfig=$1 found
+    shift
+    found=(`oc get "$@" -n $NAMESPACE --kubeconfig $kubeconfig --ignore-not-found -o=jsonpath='{.metadata.name} {.metadata.labels.app\.kubernetes\.io/managed-by}'`) || return 1
+    [[ ${#found[@]} -eq 0 || ${found[1]} == "${MANAGED_BY_LABEL#*=}" ]]
+}
+
+# Succeeds once the trim pod has terminated.
+trim_done() {
+    local phase
+    phase=`oc get po $VM_NAME-dst-trim -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.status.phase}'` || return 2
+    [[ $phase == "Succeeded" || $phase == "Failed" ]]
+}
+
+# Deletes the trim pod.
+delete_trim_pod() {
+    oc delete po $VM_NAME-dst-trim -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --ignore-not-found --wait > /dev/null
+}
+
+# Discards the unused blocks of the destination disk image with virt-sparsify,
+# while the destination VM is still stopped and no sshfs mount holds the
+# image. The destination replicator image has no virt-sparsify, so the trim
+# runs in a short-lived pod with the migrator image, on the node of the
+# destination replicator, which still mounts the same PVC. A failed trim
+# leaves the synced data usable, so it only prints a warning.
+trim_destination_disk() {
+    local repl phase
+    echo "Trimming destination disk (--trim-after-cutover)"
+    repl=(`oc get po $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.spec.nodeName} {.spec.imagePullSecrets[0].name}'`)
+    export DISK_IMAGE TRIM_NODE=${repl[0]} TRIM_PULL_SECRET=${repl[1]}
+    yq e -i '.metadata.name = env(VM_NAME)+"-dst-trim"' $WORK_DIR/manifests/dst-trim.yaml
+    yq e -i '.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' $WORK_DIR/manifests/dst-trim.yaml
+    yq e -i '.spec.containers[0].command[2] = "/data/simg/" + strenv(DISK_IMAGE)' $WORK_DIR/manifests/dst-trim.yaml
+    if [[ -n $TRIM_NODE ]]; then
+        yq e -i '.spec.nodeName = strenv(TRIM_NODE)' $WORK_DIR/manifests/dst-trim.yaml
+    fi
+    if [[ -n $TRIM_PULL_SECRET ]]; then
+        yq e -i '.spec.imagePullSecrets = [{"name": strenv(TRIM_PULL_SECRET)}]' $WORK_DIR/manifests/dst-trim.yaml
+    fi
+    delete_trim_pod
+    if ! oc apply -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f $WORK_DIR/manifests/dst-trim.yaml > /dev/null; then
+        echo "Warning: could not create the trim pod, continuing with the cutover."
+        return
+    fi
+    if ! wait_for $POLL_INTERVAL $TRIM_TIMEOUT trim_done; then
+        echo "Warning: the destination disk was not trimmed within ${TRIM_TIMEOUT}s, continuing with the cutover."
+        delete_trim_pod
+        return
+    fi
+    phase=`oc get po $VM_NAME-dst-trim -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -o=jsonpath='{.status.phase}'`
+    oc logs $VM_NAME-dst-trim -n $NAMESPACE --kubeconfig $DST_KUBECONFIG
+    if [[ $phase != "Succeeded" ]]; then
+        echo "Warning: could not trim the destination disk, continuing with the cutover."
+    fi
+    delete_trim_pod
+}
+
+# Deletes a resource, retrying transient errors a few times so a briefly
+# unavailable API server does not leave replication resources behind.
+# Resources without MANAGED_BY_LABEL are left alone unless --force-cleanup is
+# set, since they may be unrelated resources whose names collide. Failures
+# are collected in FAILED_DELETES and reported once cleanup finishes.
+delete_with_retry() {
+    local kubeconfig=$1 err
+    shift
+    if [[ $FORCE_CLEANUP -ne 1 ]] && ! is_managed $kubeconfig "$@"; then
+        echo "Refusing to delete $*: it is not labeled $MANAGED_BY_LABEL. Use --force-cleanup to delete it anyway."
+        FAILED_DELETES+=("$*")
+        return 1
+    fi
+    for attempt in $(seq 1 $DELETE_RETRIES); do
+        if { err=`oc delete "$@" -n $NAMESPACE --kubeconfig $kubeconfig --wait --ignore-not-found 2>&1 1>&3`; } 3>&1; then
+            return 0
+        fi
+        echo "Deleting $* failed (attempt $attempt/$DELETE_RETRIES): $err"
+        if ! is_retryable "$err"; then
+            break
+        fi
+        sleep 5
+    done
+    FAILED_DELETES+=("$*")
+    return 1
 }
 
 VM_NAME=""
+VM_UID=""
+VM_FILE=""
 NAMESPACE=""
 SRC_KUBECONFIG=""
 DST_KUBECONFIG=""
 VERBOSE=0
 PVC_NAME=""
+CUTOVER_ONLY=0
+POLL_INTERVAL=5
+FINAL_SYNC_TIMEOUT=7200
+DST_RUN_STATE="running"
+TRIM_AFTER_CUTOVER=0
+DISK_IMAGE="disk.img"
+REQUIRE_CONFIRMATION=0
+DELETE_RETRIES=3
+JOB_CREATE_RETRIES=5
+ACTIVE_JOB_TIMEOUT=1800
+TRIM_TIMEOUT=3600
+FAILED_DELETES=()
+FORCE_CLEANUP=0
+FORCE=0
+TEMP_DIR="${TMPDIR:-/tmp}"
+VERBOSE_COMMANDS=0
+KUBE_EXTRA_ARGS=()
+REQUIRE_TLS_VERIFY=0
+REPORT_FILE=""
+LAST_ERROR=""
+ALL_VMS=0
+EXCLUDE_VMS=()
+VM_SELECTOR=""
+MAX_RETRIES_PER_VM=0
 
+strip_batch_args "$@"
 while [[ $# -gt 0 ]]; do
     case "$1" in
         --vm-name)
@@ -26,6 +271,14 @@ while [[ $# -gt 0 ]]; do
             export VM_NAME
             shift 2
             ;;
+        --vm-uid)
+            VM_UID="$2"
+            shift 2
+            ;;
+        --vm-file)
+            VM_FILE="$2"
+            shift 2
+            ;;
         --namespace)
             NAMESPACE="$2"
             export NAMESPACE
@@ -41,8 +294,88 @@ while [[ $# -gt 0 ]]; do
             export DST_KUBECONFIG
             shift 2
             ;;
+        --cutover-only)
+            CUTOVER_ONLY=1
+            shift
+            ;;
+        --all-vms)
+            ALL_VMS=1
+            shift
+            ;;
+        --exclude-vm)
+            EXCLUDE_VMS+=("$2")
+            shift 2
+            ;;
+        --vm-selector)
+            VM_SELECTOR="$2"
+            shift 2
+            ;;
+        --max-retries-per-vm)
+            if [[ ! "$2" =~ ^[0-9]+$ ]]; then
+                echo "Error: --max-retries-per-vm must be a non-negative number."
+                usage
+            fi
+            MAX_RETRIES_PER_VM="$2"
+            shift 2
+            ;;
+        --report-file)
+            REPORT_FILE="$2"
+            shift 2
+            ;;
+        --require-confirmation)
+            REQUIRE_CONFIRMATION=1
+            shift
+            ;;
+        --force-cleanup)
+            FORCE_CLEANUP=1
+            shift
+            ;;
+        --force)
+            FORCE=1
+            shift
+            ;;
+        --temp-dir)
+            TEMP_DIR="$2"
+            shift 2
+            ;;
+        --verbose-commands)
+            VERBOSE_COMMANDS=1
+            shift
+            ;;
+        --require-tls-verify)
+            REQUIRE_TLS_VERIFY=1
+            shift
+            ;;
+        --kube-extra-arg)
+            if [[ "$2" != -* ]]; then
+                echo "Error: --kube-extra-arg must be a flag, with its value after '=' (e.g. --as=admin)."
+                usage
+            fi
+            KUBE_EXTRA_ARGS+=("$2")
+            shift 2
+            ;;
+        --poll-interval)
+            POLL_INTERVAL="$2"
+            shift 2
+            ;;
+        --trim-after-cutover)
+            TRIM_AFTER_CUTOVER=1
+            shift
+            ;;
+        --disk-image-name)
+            DISK_IMAGE="$2"
+            shift 2
+            ;;
+        --dst-run-state)
+            DST_RUN_STATE="$2"
+            shift 2
+            ;;
+        --final-sync-timeout)
+            FINAL_SYNC_TIMEOUT="$2"
+            shift 2
+            ;;
         --help)
-            usage
+            usage 0
             ;;
         *)
             echo "Unknown option: $1"
@@ -51,77 +384,123 @@ while [[ $# -gt 0 ]]; do
     esac
 done
 
+if [[ -n "$VM_FILE" ]]; then
+    read_vm_file || usage
+fi
+
+if [[ $ALL_VMS -eq 1 ]]; then
+    if [[ -n "$VM_NAME" || -n "$VM_UID" || -z "$NAMESPACE" || -z "$SRC_KUBECONFIG" || -z "$DST_KUBECONFIG" ]]; then
+        echo "Error: --all-vms requires --namespace, --src-kubeconfig and --dst-kubeconfig and cannot be combined with --vm-name or --vm-uid."
+        usage
+    fi
+    run_batch
+    exit $?
+elif [[ ${#EXCLUDE_VMS[@]} -gt 0 || -n "$VM_SELECTOR" || $MAX_RETRIES_PER_VM -gt 0 ]]; then
+    echo "Error: --exclude-vm, --vm-selector and --max-retries-per-vm can only be used with --all-vms."
+    usage
+fi
+
 if [[ -z "$VM_NAME" || -z "$NAMESPACE" || -z "$SRC_KUBECONFIG" || -z "$DST_KUBECONFIG" ]]; then
     echo "Error: --vm-name, --namespace, --src-kubeconfig, and --dst-kubeconfig are required."
     usage
+elif [[ ! "$VM_NAME" =~ $DNS1123_SUBDOMAIN || ${#VM_NAME} -gt 253 ]]; then
+    echo "Error: --vm-name must be a valid DNS-1123 subdomain (lowercase alphanumerics, '-' and '.')."
+    usage
+elif [[ ! "$NAMESPACE" =~ $DNS1123_LABEL || ${#NAMESPACE} -gt 63 ]]; then
+    echo "Error: --namespace must be a valid DNS-1123 label (lowercase alphanumerics and '-', at most 63 characters)."
+    usage
+elif [[ ! "$POLL_INTERVAL" =~ ^[1-9][0-9]*$ ]]; then
+    echo "Error: --poll-interval must be a positive number of seconds."
+    usage
+elif [[ $DST_RUN_STATE != "running" && $DST_RUN_STATE != "stopped" ]]; then
+    echo "Error: --dst-run-state must be running or stopped."
+    usage
+elif [[ ! "$DISK_IMAGE" =~ ^[A-Za-z0-9_][A-Za-z0-9._-]*$ ]]; then
+    echo "Error: --disk-image-name must be a plain file name such as disk.img."
+    usage
+elif [[ ! "$FINAL_SYNC_TIMEOUT" =~ ^[0-9]+$ ]]; then
+    echo "Error: --final-sync-timeout must be a number of seconds."
+    usage
+elif [[ ! -d "$TEMP_DIR" || ! -w "$TEMP_DIR" ]]; then
+    echo "Error: --temp-dir $TEMP_DIR is not a writable directory."
+    usage
 else
+    if [[ -n $REPORT_FILE ]]; then
+        add_exit_hook write_report
+    fi
+    make_work_dir || exit 1
+    check_tls_verify $SRC_KUBECONFIG source || exit $EXIT_CLUSTER
+    check_tls_verify $DST_KUBECONFIG destination || exit $EXIT_CLUSTER
+    check_kubevirt $SRC_KUBECONFIG source || exit $EXIT_CLUSTER
+    check_vm_uid || exit 1
+    check_kubevirt $DST_KUBECONFIG destination || exit $EXIT_CLUSTER
+    acquire_lock || exit $?
+    if [[ $CUTOVER_ONLY -eq 1 ]]; then
+        echo "Verifying replication was initialized"
+        verify_init_completed || exit 1
+    fi
+
     echo "Checking source VM status"
-    src_vm_state=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --no-headers | awk '{print $3}'`
-    if [[ $? -eq 0 ]]; then echo $src_vm_state; else echo "No Running VM" ; fi
+    src_vm_state=`vm_status $SRC_KUBECONFIG`
+    if [[ -n $src_vm_state ]]; then echo $src_vm_state; else echo "No Running VM" ; fi
     
     echo "Checking destination VM status"
-    dst_vm_state=`oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}'`
-    if [[ $? -eq 0 ]]; then echo $dst_vm_state; else echo "No Running VM"; fi
+    dst_vm_state=`vm_status $DST_KUBECONFIG`
+    if [[ -n $dst_vm_state ]]; then echo $dst_vm_state; else echo "No Running VM"; fi
 
     if [[ $dst_vm_state != "Stopped" ]]; then
-        if [[ $dst_vm_state == "" ]]; then
-            echo "Exporting VM from source cluster"
-            oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o yaml > $VM_NAME-vm.yaml
-            yq e -i '.spec.running = false' $VM_NAME-vm.yaml
-            oc apply --wait -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f $VM_NAME-vm.yaml
-            echo "Waiting for the destination VM to be created ...... "
-            c=1
-            while [[ $( oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}') != "Stopped"  ]]
-            do
-                echo "$i"
-                i=$[$i +5]
-                sleep 5
-            done
+        vm_exists $DST_KUBECONFIG
+        dst_vm_exists=$?
+        if [[ $dst_vm_exists -eq 2 ]]; then
+            LAST_ERROR="could not check whether the destination VM exists"
+            echo "Error: $LAST_ERROR."
+            exit 1
         fi
-        if [[ $dst_vm_state == "Running" ]]; then
-            virtctl stop $VM_NAME --kubeconfig $DST_KUBECONFIG
+        # init.sh creates the destination VM with --network-map, annotation
+        # filtering, the persistent EFI/TPM check and --dst-vm-patch applied;
+        # a raw copy of the source VM could reference networks that do not
+        # exist on the destination cluster.
+        if [[ $dst_vm_exists -eq 1 ]]; then
+            LAST_ERROR="destination VM does not exist"
+            echo "Error: destination VM $VM_NAME does not exist. Re-run init.sh with the same flags to create it and replicate its disk."
+            exit 1
         fi
+        vmi_absent $DST_KUBECONFIG
+        case $? in
+            1)
+                if [[ $FORCE -ne 1 ]]; then
+                    LAST_ERROR="destination VM is $dst_vm_state"
+                    echo "Error: destination VM $VM_NAME is $dst_vm_state and has a running instance; replicating onto its disk would corrupt it. Use --force to stop it and continue."
+                    exit 1
+                fi
+                echo "Stopping destination VM (--force)"
+                virtctl stop $VM_NAME --kubeconfig $DST_KUBECONFIG || exit 1
+                wait_for $POLL_INTERVAL 0 vmi_absent $DST_KUBECONFIG || exit 1
+                ;;
+            2)
+                LAST_ERROR="could not check whether the destination VM is running"
+                echo "Error: $LAST_ERROR."
+                exit 1
+                ;;
+        esac
     fi
     
     echo "Checking source Replicator"
-    src_repl_state=`oc get po $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --no-headers | awk '{print $3}' | grep -v "NotFound"`
-    if [[ $? -eq 0 ]]; then echo $src_repl_state; else echo "No Running Replicator" ; fi
+    src_repl_state=`pod_status $VM_NAME-src-replicator $SRC_KUBECONFIG`
+    if [[ -n $src_repl_state ]]; then echo $src_repl_state; else echo "No Running Replicator" ; fi
     
     echo "Checking destination Replicator"
-    dst_repl_state=`oc get po $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}' | grep -v "NotFound"`
-    if [[ $? -eq 0 ]]; then echo $dst_repl_state; else echo "No Running Replicator" ; fi
-
-    if [[ $src_repl_state != "Running" ]]; then 
-        echo "Creating source Replicator"
-        yq -i '.metadata.name = strenv(VM_NAME)+"-src-replicator"' manifests/src-repl.yaml
-        yq e -i '.metadata.labels.app = env(VM_NAME)+"-src-replicator"' manifests/src-repl.yaml
-        yq e -i '.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' manifests/src-repl.yaml
-        oc apply --wait -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -f manifests/src-repl.yaml 
-
-        echo "Generating source replicator SSH key"
-        oc exec $VM_NAME-src-replicator -ti -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- bash -c "ssh-keygen -t rsa -b 4096 -N '' -f ~/.ssh/id_rsa"
-        oc wait pod $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --for=condition=Ready --timeout=-1m
-        echo "Generating source SSH secret"
-        oc cp $VM_NAME-src-replicator:/root/.ssh/id_rsa id_rsa -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
-        oc cp $VM_NAME-src-replicator:/root/.ssh/id_rsa.pub id_rsa.pub -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
-        oc create secret generic $VM_NAME-repl-ssh-keys --from-file=id_rsa --from-file=id_rsa.pub -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
-        src_repl_state=`oc get po $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --no-headers | awk '{print $3}' | grep -v "NotFound"`
-    fi
-
-    if [[ $dst_repl_state != "Running" ]]; then 
-        echo "Creating destination Replicator"
-        yq e -i '.metadata.name = env(VM_NAME)+"-dst-replicator"' manifests/dst-repl.yaml
-        yq e -i '.metadata.labels.app = env(VM_NAME)+"-dst-replicator"' manifests/dst-repl.yaml
-        yq e -i '.spec.volumes[0].persistentVolumeClaim.claimName = env(VM_NAME)' manifests/dst-repl.yaml
-        oc apply --wait -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f manifests/dst-repl.yaml
-        yq e -i '.metadata.name = env(VM_NAME)+"-dst-svc"' manifests/dst-repl-svc.yaml
-        yq e -i '.metadata.labels.app = env(VM_NAME)+"-dst-replicator"' manifests/dst-repl-svc.yaml
-        yq e -i '.spec.selector.app = env(VM_NAME)+"-dst-replicator"' manifests/dst-repl-svc.yaml
-        oc wait pod $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --for=condition=Ready --timeout=-1m
-        oc apply -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -f manifests/dst-repl-svc.yaml
-        src_ssh_key=`oc exec $VM_NAME-src-replicator -ti -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -- bash -c "cat ~/.ssh/id_rsa.pub"`
-        oc exec $VM_NAME-dst-replicator -ti -n $NAMESPACE --kubeconfig $DST_KUBECONFIG -- bash -c "mkdir ~/.ssh; echo '$src_ssh_key' > ~/.ssh/authorized_keys; chmod 600 ~/.ssh/authorized_keys"
-        dst_repl_state=`oc get po $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}' | grep -v "NotFound"`
+    dst_repl_state=`pod_status $VM_NAME-dst-replicator $DST_KUBECONFIG`
+    if [[ -n $dst_repl_state ]]; then echo $dst_repl_state; else echo "No Running Replicator" ; fi
+
+    # The replicators are rendered from init.sh's flags (tolerations, pull
+    # secret, security context, CA bundle, ...), and the CronJob embeds the
+    # destination replicator's node and port, so only init.sh can recreate
+    # them, e.g. after --replicator-ttl expired.
+    if [[ $src_repl_state != "Running" || $dst_repl_state != "Running" ]]; then
+        LAST_ERROR="replicators are not running"
+        echo "Error: the source and destination replicators must be running (source: ${src_repl_state:-missing}, destination: ${dst_repl_state:-missing}). Re-run init.sh with the same flags and --only replicators,ssh,cronjob to recreate them."
+        exit 1
     fi
 
     if [ $src_repl_state == "Running" -a $dst_repl_state == "Running" ]; then 
@@ -133,34 +512,66 @@ else
         echo $dst_host_ip
         echo "Suspending CronJob"
         oc patch cronjob $VM_NAME-repl-cronjob -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -p '{"spec" : {"suspend" : true }}' 
-        echo "Stopping source VM"
-        virtctl stop $VM_NAME --kubeconfig $SRC_KUBECONFIG
-        while [[ $( oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --no-headers | awk '{print $3}') != "Stopped"  ]]
-        do
-            echo "$i"
-            i=$[$i +5]
-            sleep 5
-        done
+        if ! wait_for_active_jobs; then
+            LAST_ERROR="replication jobs did not finish before the cutover"
+            echo "Resuming CronJob, the source VM was not stopped"
+            resume_cronjob
+            exit 1
+        fi
+        if [[ $REQUIRE_CONFIRMATION -eq 1 ]] && ! confirm_cutover; then
+            LAST_ERROR="cutover declined"
+            exit 1
+        fi
+        if [[ $src_vm_state == "Stopped" ]]; then
+            echo "Source VM is already stopped, resuming with the final replication"
+        else
+            echo "Stopping source VM"
+            virtctl stop $VM_NAME --kubeconfig $SRC_KUBECONFIG
+            wait_for $POLL_INTERVAL 0 vm_status_is $SRC_KUBECONFIG Stopped
+        fi
         echo "Creating final replication job"
-        oc create job --from=cronjob/$VM_NAME-repl-cronjob $VM_NAME-repl-final-job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG
+        if ! create_final_job; then
+            LAST_ERROR="could not create the final replication job"
+            echo "Error: $LAST_ERROR."
+            exit $EXIT_CUTOVER
+        fi
         echo "Waiting final replication"
-        oc wait job $VM_NAME-repl-final-job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --for=condition=complete --timeout=-1m
-        echo "Starting destination VM"
-        virtctl start $VM_NAME --kubeconfig $DST_KUBECONFIG
-        while [[ $( oc get vm $VM_NAME -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --no-headers | awk '{print $3}') != "Running"  ]]
-        do
-            printf  "#"
-            sleep 5
-        done
+        if ! oc wait job $VM_NAME-repl-final-job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --for=condition=complete --timeout=`final_sync_timeout`; then
+            LAST_ERROR="final replication job did not complete within ${FINAL_SYNC_TIMEOUT}s"
+            echo "Error: $LAST_ERROR. The source VM is stopped and the destination VM was not started; check oc logs job/$VM_NAME-repl-final-job."
+            exit $EXIT_CUTOVER
+        fi
+        if [[ $TRIM_AFTER_CUTOVER -eq 1 ]]; then
+            trim_destination_disk
+        fi
+        if [[ $DST_RUN_STATE == "running" ]]; then
+            echo "Starting destination VM"
+            if ! virtctl start $VM_NAME --kubeconfig $DST_KUBECONFIG; then
+                LAST_ERROR="could not start the destination VM"
+                echo "Error: $LAST_ERROR. The final replication completed and the source VM is stopped; start the destination VM with virtctl start $VM_NAME."
+                exit $EXIT_CUTOVER
+            fi
+            wait_for $POLL_INTERVAL 0 vm_status_is $DST_KUBECONFIG Running
+        else
+            echo "Leaving destination VM stopped (--dst-run-state stopped)"
+        fi
         echo "Deleting final replication job"
-        oc delete job $VM_NAME-repl-final-job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --wait
+        delete_with_retry $SRC_KUBECONFIG job $VM_NAME-repl-final-job
         echo "Deleting CronJob"
-        oc delete cronjob $VM_NAME-repl-cronjob -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --wait
+        delete_with_retry $SRC_KUBECONFIG cronjob $VM_NAME-repl-cronjob
         echo "Deleting source Replicator"
-        oc delete pod $VM_NAME-src-replicator -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --wait
-        oc delete secret $VM_NAME-repl-ssh-keys -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --wait
+        delete_with_retry $SRC_KUBECONFIG pod $VM_NAME-src-replicator
+        delete_with_retry $SRC_KUBECONFIG secret $VM_NAME-repl-ssh-keys
+        delete_with_retry $SRC_KUBECONFIG pvc $VM_NAME-repl-logs
+        delete_with_retry $SRC_KUBECONFIG configmap $VM_NAME-repl-ca
         echo "Deleting destination Replicator"
-        oc delete pod $VM_NAME-dst-replicator -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --wait
-        oc delete svc $VM_NAME-dst-svc -n $NAMESPACE --kubeconfig $DST_KUBECONFIG --wait
+        delete_with_retry $DST_KUBECONFIG pod $VM_NAME-dst-replicator
+        delete_with_retry $DST_KUBECONFIG svc $VM_NAME-dst-svc
+        delete_with_retry $DST_KUBECONFIG configmap $VM_NAME-repl-ca
+        if [[ ${#FAILED_DELETES[@]} -gt 0 ]]; then
+            echo "Error: failed to delete the following resources:"
+            printf '  %s\n' "${FAILED_DELETES[@]}"
+            exit 1
+        fi
     fi
 fi
\ No newline at end of file
@@ -0,0 +1,152 @@
+#!/bin/bash
+
+source "$(dirname "$0")/lib/common.sh"
+source "$(dirname "$0")/lib/lock.sh"
+
+usage() {
+    echo "Usage: $0 --vm-name <vm-name> --namespace <namespace> --src-kubeconfig <file> [options]"
+    echo
+    echo "Runs one incremental sync of a VM initialized by init.sh now, instead of waiting for the CronJob schedule."
+    echo
+    echo "Options:"
+    echo "  --vm-name           Virtual machine name (required)"
+    echo "  --namespace         Kubernetes namespace (required)"
+    echo "  --src-kubeconfig    Source kubeconfig file path (required)"
+    echo "  --timeout           Seconds to wait for the sync to complete (optional, default 7200)"
+    echo "  --verbose-commands  Log every oc and virtctl command, with kubeconfig paths redacted (optional)"
+    echo "  --kube-extra-arg    Global flag added to every oc and virtctl command, e.g. --request-timeout=30s (optional, repeatable)"
+    echo "  --help              Display this help message and exit"
+    exit ${1:-$EXIT_USAGE}
+}
+
+# Prints the amount of data the job's last rclone stats line reports as
+# transferred, or "unknown" if the job log has none (e.g. a --sync-script
+# not using rclone).
+transferred_bytes() {
+    local line
+    line=`oc logs job/$1 -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG | tr '\r' '\n' | grep 'Transferred:.*B / ' | tail -1`
+    if [[ -z $line ]]; then
+        echo "unknown"
+        return
+    fi
+    line=${line#*Transferred:}
+    line=${line%%,*}
+    echo $line
+}
+
+# Resumes the CronJob paused while the one-off job runs, if this run is the
+# one that suspended it.
+resume_cronjob() {
+    if [[ $CRONJOB_SUSPENDED -ne 1 ]]; then
+        return
+    fi
+    oc patch cronjob $VM_NAME-repl-cronjob -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -p '{"spec" : {"suspend" : false }}'
+}
+
+VM_NAME=""
+NAMESPACE=""
+SRC_KUBECONFIG=""
+SYNC_TIMEOUT=7200
+CRONJOB_SUSPENDED=0
+VERBOSE_COMMANDS=0
+KUBE_EXTRA_ARGS=()
+
+while [[ $# -gt 0 ]]; do
+    case "$1" in
+        --vm-name)
+            VM_NAME="$2"
+            shift 2
+            ;;
+        --namespace)
+            NAMESPACE="$2"
+            shift 2
+            ;;
+        --src-kubeconfig)
+            SRC_KUBECONFIG="$2"
+            shift 2
+            ;;
+        --timeout)
+            SYNC_TIMEOUT="$2"
+            shift 2
+            ;;
+        --verbose-commands)
+            VERBOSE_COMMANDS=1
+            shift
+            ;;
+        --kube-extra-arg)
+            if [[ "$2" != -* ]]; then
+                echo "Error: --kube-extra-arg must be a flag, with its value after '=' (e.g. --as=admin)."
+                usage
+            fi
+            KUBE_EXTRA_ARGS+=("$2")
+            shift 2
+            ;;
+        --help)
+            usage 0
+            ;;
+        *)
+            echo "Unknown option: $1"
+            usage
+            ;;
+    esac
+done
+
+if [[ -z "$VM_NAME" || -z "$NAMESPACE" || -z "$SRC_KUBECONFIG" ]]; then
+    echo "Error: --vm-name, --namespace and --src-kubeconfig are required."
+    usage
+elif [[ ! "$VM_NAME" =~ $DNS1123_SUBDOMAIN || ${#VM_NAME} -gt 253 ]]; then
+    echo "Error: --vm-name must be a valid DNS-1123 subdomain (lowercase alphanumerics, '-' and '.')."
+    usage
+elif [[ ! "$NAMESPACE" =~ $DNS1123_LABEL || ${#NAMESPACE} -gt 63 ]]; then
+    echo "Error: --namespace must be a valid DNS-1123 label (lowercase alphanumerics and '-', at most 63 characters)."
+    usage
+elif [[ ! "$SYNC_TIMEOUT" =~ ^[1-9][0-9]*$ ]]; then
+    echo "Error: --timeout must be a positive number of seconds."
+    usage
+else
+    # The lock keeps migrate.sh from starting a cutover, whose final job
+    # would write the destination disk alongside the one-off job.
+    acquire_lock || exit $?
+    suspended=`oc get cronjob $VM_NAME-repl-cronjob -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -o=jsonpath='{.spec.suspend}'`
+    if [[ $? -ne 0 ]]; then
+        echo "Error: CronJob $VM_NAME-repl-cronjob not found. Run init.sh for this VM first."
+        exit 1
+    fi
+    if [[ $suspended == "true" ]]; then
+        echo "Error: CronJob $VM_NAME-repl-cronjob is suspended, a cutover may be in progress."
+        exit 1
+    fi
+    if ! active=`active_replication_jobs`; then
+        echo "Error: could not read the replication jobs of $VM_NAME."
+        exit 1
+    fi
+    if [[ -n $active ]]; then
+        echo "Error: replication job(s) $active already running; the changes will be synced by them."
+        exit 1
+    fi
+
+    # Two jobs must never mount the destination disk read-write at the same
+    # time, so the schedule is paused until the one-off job is done.
+    add_exit_hook resume_cronjob
+    oc patch cronjob $VM_NAME-repl-cronjob -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG -p '{"spec" : {"suspend" : true }}' || exit 1
+    CRONJOB_SUSPENDED=1
+
+    job=$VM_NAME-repl-sync-`date +%s`
+    echo "Creating replication job $job"
+    oc create job --from=cronjob/$VM_NAME-repl-cronjob $job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG || exit 1
+    echo "Waiting for the replication job"
+    if ! oc wait job $job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --for=condition=complete --timeout=${SYNC_TIMEOUT}s; then
+        echo "Error: replication job $job did not complete within ${SYNC_TIMEOUT}s. Its last output:"
+        oc logs job/$job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --tail=20
+        # The job may still be writing the destination disk, so it is deleted
+        # before the schedule is resumed.
+        echo "Deleting replication job $job"
+        if ! oc delete job $job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --cascade=foreground --wait; then
+            CRONJOB_SUSPENDED=0
+            echo "Error: could not delete job $job; CronJob $VM_NAME-repl-cronjob is left suspended. Delete the job, then resume it with: oc patch cronjob $VM_NAME-repl-cronjob -p '{\"spec\":{\"suspend\":false}}'"
+        fi
+        exit 1
+    fi
+    echo "Transferred: `transferred_bytes $job`"
+    oc delete job $job -n $NAMESPACE --kubeconfig $SRC_KUBECONFIG --wait
+fi
\ No newline at end of file
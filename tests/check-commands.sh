@@ -0,0 +1,153 @@
+#!/bin/bash
+# Checks what the scripts do without a cluster: the in-pod commands init.sh
+# generates for the initial copy and the cronjob, and the validation and
+# helpers that need no oc call. The functions are loaded from the scripts as
+# they are.
+# Run it from anywhere: ./tests/check-commands.sh
+
+source "$(dirname "$0")/../lib/common.sh"
+
+INIT_SH="$(dirname "$0")/../init.sh"
+FAILURES=0
+
+# Loads the named functions from init.sh without running the script.
+load_functions() {
+    local f body
+    for f in "$@"; do
+        body=`sed -n "/^$f() {/,/^}/p" $INIT_SH`
+        eval "$body"
+    done
+}
+
+# Compares the actual value with the expected one and records a failure.
+expect_eq() {
+    if [[ $2 == "$3" ]]; then
+        echo "ok: $1"
+    else
+        echo "FAIL: $1"
+        echo "  expected: $3"
+        echo "  actual:   $2"
+        FAILURES=$((FAILURES + 1))
+    fi
+}
+
+load_functions sshfs_options sshfs_mount_command wait_mounted_command guestmount_commands sync_tool_command initial_copy_command default_sync_script
+
+DISK_IMAGE="disk.img"
+DST_HOST_IP="10.0.0.1"
+DST_NODE_PORT="30022"
+SYNC_TOOL="rclone"
+MOUNT_TIMEOUT=2
+
+COPY_PROVIDER="cp"
+expect_eq "cp initial copy" "`initial_copy_command`" 'cp -p --sparse=always /data/simg/disk.img /data/dimg/ & progress -m; wait $!'
+
+COPY_PROVIDER="rsync-block"
+expect_eq "rsync-block initial copy" "`initial_copy_command`" "rsync --inplace --sparse --no-whole-file --progress /data/simg/disk.img /data/dimg/"
+
+expect_eq "sshfs mount" "`sshfs_mount_command`" "sshfs -o StrictHostKeyChecking=no -o port=30022 10.0.0.1:/data/simg /data/dimg"
+
+expect_eq "guestmount" "`guestmount_commands`" "guestmount -a /data/simg/disk.img -m /dev/sda4 --ro /data/sfs && guestmount -a /data/dimg/disk.img -m /dev/sda4 --rw /data/dfs"
+
+# The mount wait must fail, not fall through, when the directory never
+# becomes a mount point.
+dir=`mktemp -d`
+wait_dir=`wait_mounted_command $dir`
+out=`bash -c "$wait_dir && echo continued"`
+expect_eq "mount wait fails on timeout" "$?:$out" "1:$dir is not mounted"
+rmdir $dir
+
+wait_root=`wait_mounted_command /`
+expect_eq "mount wait succeeds on a mount point" "`bash -c "$wait_root && echo continued"`" "continued"
+
+script=`default_sync_script`
+bash -n -c "$script"
+expect_eq "sync script syntax" "$?" "0"
+expect_eq "sync script ends with the sync result" "${script##*; }" '[ $rc -eq 0 ]'
+
+# --vm-name ends up in resource names and in bash -c strings run in the
+# replicators, so only DNS-1123 subdomains are accepted.
+for name in vm rhel9-test-22 vm.prod a1; do
+    [[ $name =~ $DNS1123_SUBDOMAIN ]]
+    expect_eq "valid vm name '$name'" "$?" "0"
+done
+for name in 'my vm' 'vm;id' 'vm`id`' 'VM' '-vm' 'vm$(id)'; do
+    for script in init.sh migrate.sh; do
+        out=`"$(dirname "$0")/../$script" --vm-name "$name" --namespace ns --src-kubeconfig /dev/null --dst-kubeconfig /dev/null 2>&1`
+        expect_eq "$script rejects vm name '$name'" "$?:${out%%$'\n'*}" "2:Error: --vm-name must be a valid DNS-1123 subdomain (lowercase alphanumerics, '-' and '.')."
+    done
+done
+
+# is_retryable tells transient API errors, worth a retry, from fatal ones.
+for err in \
+    'Unable to connect to the server: dial tcp 10.0.0.1:6443: connect: connection refused' \
+    'Unable to connect to the server: net/http: TLS handshake timeout' \
+    'Unable to connect to the server: dial tcp 10.0.0.1:6443: i/o timeout' \
+    'Error from server (ServiceUnavailable): the server is currently unable to handle the request' \
+    'Error from server (TooManyRequests): the server has received too many requests' \
+    'Error from server (InternalError): etcdserver: request timed out' \
+    'error: unexpected EOF'; do
+    is_retryable "$err"
+    expect_eq "retryable: $err" "$?" "0"
+done
+for err in \
+    'Error from server (NotFound): virtualmachines.kubevirt.io "vm" not found' \
+    'Error from server (Forbidden): pods is forbidden: User "dev" cannot list resource "pods"' \
+    'Error from server (AlreadyExists): secrets "vm-repl-ssh-keys" already exists' \
+    'error: the server doesn'"'"'t have a resource type "vm"'; do
+    is_retryable "$err"
+    expect_eq "fatal: $err" "$?" "1"
+done
+
+# --only and --skip select the init phases by name.
+load_functions phase_enabled
+enabled_phases() {
+    local phase enabled=()
+    for phase in dest-vm replicators ssh initial-sync cronjob; do
+        if phase_enabled $phase; then
+            enabled+=($phase)
+        fi
+    done
+    echo ${enabled[*]}
+}
+ONLY_PHASES="" SKIP_PHASES=""
+expect_eq "all phases by default" "`enabled_phases`" "dest-vm replicators ssh initial-sync cronjob"
+ONLY_PHASES="replicators" SKIP_PHASES=""
+expect_eq "--only replicators" "`enabled_phases`" "replicators"
+ONLY_PHASES="replicators,ssh,cronjob" SKIP_PHASES=""
+expect_eq "--only replicators,ssh,cronjob" "`enabled_phases`" "replicators ssh cronjob"
+ONLY_PHASES="" SKIP_PHASES="initial-sync"
+expect_eq "--skip initial-sync" "`enabled_phases`" "dest-vm replicators ssh cronjob"
+ONLY_PHASES="ssh,cronjob" SKIP_PHASES="cronjob"
+expect_eq "--only with --skip" "`enabled_phases`" "ssh"
+ONLY_PHASES="" SKIP_PHASES=""
+for opt in --only --skip; do
+    out=`"$(dirname "$0")/../init.sh" $opt replicator --vm-name vm --namespace ns --src-kubeconfig /dev/null --dst-kubeconfig /dev/null 2>&1`
+    expect_eq "$opt rejects an unknown phase" "$?" "2"
+done
+
+# A --sync-script template is embedded base64 encoded, with its placeholders
+# substituted.
+load_functions sync_command
+SYNC_SCRIPT=`mktemp`
+cat > $SYNC_SCRIPT <<'SCRIPT'
+sshfs -o port=${NODE_PORT} ${HOST_IP}:/data/simg /data/dimg
+${SYNC_TOOL} sync /data/sfs/ /data/dfs/ # ${DISK_IMAGE}, $HOME
+SCRIPT
+DST_NODE_PORT="30022" DST_HOST_IP="10.0.0.1" SYNC_TOOL="rsync" DISK_IMAGE="root.img"
+command=`sync_command`
+expect_eq "sync script is embedded base64 encoded" "${command%% *} ${command##* | }" "echo /bin/bash"
+encoded=${command#echo }
+expect_eq "sync script placeholders are substituted" "`echo ${encoded%% *} | base64 -d`" 'sshfs -o port=30022 10.0.0.1:/data/simg /data/dimg
+rsync sync /data/sfs/ /data/dfs/ # root.img, $HOME'
+echo 'rclone sync /data/sfs/ /data/dfs/ # ${HOST_IP}' > $SYNC_SCRIPT
+out=`"$(dirname "$0")/../init.sh" --sync-script $SYNC_SCRIPT --vm-name vm --namespace ns --src-kubeconfig /dev/null --dst-kubeconfig /dev/null 2>&1`
+expect_eq "sync script without \${NODE_PORT} is rejected" "$?:${out%%$'\n'*}" '2:Error: --sync-script must use the ${NODE_PORT} and ${HOST_IP} placeholders.'
+rm -f $SYNC_SCRIPT
+SYNC_SCRIPT=""
+
+if [[ $FAILURES -gt 0 ]]; then
+    echo "$FAILURES check(s) failed"
+    exit 1
+fi
+echo "All checks passed"
\ No newline at end of file